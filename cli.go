@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"spotifyfs/pkg/crypto"
+	"spotifyfs/pkg/fec"
+	"spotifyfs/pkg/job"
+	"spotifyfs/pkg/spotify"
+	"strconv"
+	"strings"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitAuth    = 3
+	exitCorrupt = 4
+)
+
+const (
+	envPassword   = "SPOTIFYFS_PASSWORD"
+	envDecoder    = "SPOTIFYFS_DECODER"
+	envName       = "SPOTIFYFS_NAME"
+	envTokenCache = "SPOTIFYFS_TOKEN_CACHE"
+	envHeadless   = "SPOTIFYFS_HEADLESS"
+	envListen     = "SPOTIFYFS_LISTEN"
+	envRedirect   = "SPOTIFYFS_REDIRECT_URI"
+
+	envDecoderPassword = "SPOTIFYFS_DECODER_PASSWORD"
+	envNewPassword     = "SPOTIFYFS_NEW_PASSWORD"
+	envDictionaryCache = "SPOTIFYFS_DICTIONARY_CACHE"
+	envMarket          = "SPOTIFYFS_MARKET"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"put", "FILE [--name NAME] [--resume] [--compress MODE]", "Write a file to a chain of playlists", runPut},
+		{"get", "PLAYLIST_ID [-o FILE] [--decoder PATH]", "Read a file back from a playlist chain", runGet},
+		{"verify", "PLAYLIST_ID [--decoder PATH]", "Check that a chain decodes to its original size and hash", runVerify},
+		{"ls", "[--json]", "List the files stored in the account", runLs},
+		{"info", "PLAYLIST_ID", "Show the playlists that make up a chain", runInfo},
+		{"visibility", "PLAYLIST_ID private|public|collaborative", "Change who can see the playlists of an upload", runVisibility},
+		{"rm", "PLAYLIST_ID|JOURNAL [--dry-run] [--yes]", "Unfollow every playlist of an upload", runRm},
+		{"rekey", "DECODER [--new-password PASSWORD]", "Re-encrypt a decoder file under a new password", runRekey},
+		{"dict", "verify DECODER [--fix]", "Check the tracks of a decoder file against the catalog", runDict},
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, banner)
+	fmt.Fprintf(os.Stderr, "\nUsage: spotify-fs <command> [arguments]\n\nCommands:\n")
+	nameWidth, width := 0, 0
+	for _, c := range commands {
+		nameWidth = max(nameWidth, len(c.name))
+		width = max(width, len(c.args))
+	}
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-*s %-*s %s\n", nameWidth, c.name, width, c.args, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nEnvironment:\n  %s, %s, %s, %s,\n  %s, %s, %s, %s,\n  %s, %s, %s\n",
+		envPassword, envDecoder, envDecoderPassword, envNewPassword, envName, envTokenCache, envDictionaryCache, envMarket, envHeadless, envListen, envRedirect)
+	fmt.Fprintf(os.Stderr, "\nRun 'spotify-fs <command> -h' for the flags of a command.\n")
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "-h", "--help", "help":
+		usage()
+		return exitOK
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+	usage()
+	return exitUsage
+}
+
+// parseArgs lets flags appear before, between or after the positional
+// arguments, which the flag package alone does not allow.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// flagSet reports whether the flag name was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: spotify-fs %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func stringFlag(fs *flag.FlagSet, p *string, long, short, env, usage string) {
+	*p = os.Getenv(env)
+	if env != "" {
+		usage = fmt.Sprintf("%s (env %s)", usage, env)
+	}
+	fs.StringVar(p, long, *p, usage)
+	if short != "" {
+		fs.StringVar(p, short, *p, "shorthand for --"+long)
+	}
+}
+
+type authOptions struct {
+	headless    bool
+	listenAddr  string
+	redirectURL string
+}
+
+func authFlags(fs *flag.FlagSet) *authOptions {
+	opts := &authOptions{}
+	opts.headless, _ = strconv.ParseBool(os.Getenv(envHeadless))
+	fs.BoolVar(&opts.headless, "headless", opts.headless, fmt.Sprintf("log in by pasting the redirect URL instead of running a local server (env %s)", envHeadless))
+	stringFlag(fs, &opts.listenAddr, "listen", "", envListen, "address the login callback server listens on (default "+spotify.DefaultListenAddr+")")
+	stringFlag(fs, &opts.redirectURL, "redirect-uri", "", envRedirect, "redirect URI registered for the Spotify app (default "+spotify.DefaultRedirectURL+")")
+	return opts
+}
+
+func passwordFlag(fs *flag.FlagSet, p *string) {
+	stringFlag(fs, p, "password", "p", envPassword, "password used as the dictionary seed")
+}
+
+func decoderFlags(fs *flag.FlagSet, decoder, decoderPassword *string) {
+	stringFlag(fs, decoder, "decoder", "d", envDecoder, "path to the _Decoder.gob file")
+	stringFlag(fs, decoderPassword, "decoder-password", "", envDecoderPassword, "password of a decoder file rekeyed to a different one (defaults to --password)")
+}
+
+// dictionaryFlags sets how put searches for its dictionary. The reader
+// finds the same settings in the upload.
+func dictionaryFlags(fs *flag.FlagSet) *crypto.DictionarySpec {
+	spec := crypto.DefaultDictionarySpec()
+	if market := os.Getenv(envMarket); market != "" {
+		spec.Market = market
+	}
+	fs.StringVar(&spec.Market, "market", spec.Market, fmt.Sprintf("market the dictionary tracks are searched in (env %s)", envMarket))
+	fs.IntVar(&spec.QueryLength, "query-length", spec.QueryLength, "characters per dictionary search query")
+	fs.StringVar(&spec.Charset, "charset", spec.Charset, "characters dictionary search queries are drawn from")
+	fs.StringVar(&spec.SearchType, "search-type", spec.SearchType, "field dictionary searches match: track, artist or album (default any)")
+	fs.IntVar(&spec.Results, "results", spec.Results, "results taken from each dictionary search, 1 to 50")
+	fs.IntVar(&spec.Offset, "result-offset", spec.Offset, "index of the first result taken from each dictionary search")
+	fs.IntVar(&spec.Homophones, "homophones", 1, "tracks standing for each symbol, picked at random when writing, up to 16")
+	return &spec
+}
+
+func interactive() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// resolvePassword only falls back to a prompt when a human is attached to
+// stdin; scripted runs must pass the password by flag or environment.
+func resolvePassword(password *string) error {
+	if *password != "" {
+		return nil
+	}
+	if !interactive() {
+		return fmt.Errorf("No password given, use --password or %s", envPassword)
+	}
+	StringInput("Enter password to use as a seed: ", password, false)
+	return nil
+}
+
+func parseCommand(fs *flag.FlagSet, args []string, positional int) ([]string, int) {
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, exitOK
+		}
+		return nil, exitUsage
+	}
+	if len(rest) != positional {
+		fmt.Fprintf(os.Stderr, "Expected %d argument(s), got %d\n", positional, len(rest))
+		fs.Usage()
+		return nil, exitUsage
+	}
+	return rest, -1
+}
+
+func readFailure(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	var unknownTrack *job.ErrUnknownTrack
+	if errors.Is(err, job.ErrSizeMismatch) || errors.Is(err, job.ErrChecksumMismatch) ||
+		errors.Is(err, job.ErrIndexMismatch) || errors.Is(err, crypto.ErrAuthentication) ||
+		errors.Is(err, crypto.ErrCorrupt) || errors.Is(err, job.ErrCorrupt) ||
+		errors.Is(err, fec.ErrTooManyErasures) ||
+		errors.As(err, &unknownTrack) {
+		return exitCorrupt
+	}
+	return exitFailure
+}
+
+func connect(opts *authOptions) (*spotify.SpotifyClient, int) {
+	client, err := initSpotify(*opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitAuth
+	}
+	return &client, -1
+}
+
+func runPut(args []string) int {
+	var name, password string
+	var opts job.WriteOptions
+	fs := newFlagSet("put", "FILE [--name NAME] [--resume] [--compress MODE]")
+	auth := authFlags(fs)
+	stringFlag(fs, &name, "name", "n", envName, "name of the playlist (defaults to the file name)")
+	passwordFlag(fs, &password)
+	fs.BoolVar(&opts.Resume, "resume", false, "continue an interrupted upload from its journal")
+	fs.StringVar(&opts.Compression, "compress", job.CompressionAuto, "compression: auto (gzip when the file compresses), gzip or none")
+	fs.IntVar(&opts.ParityShards, "parity", 4, "Reed-Solomon parity shards per playlist, how many damaged shards each playlist survives (0 disables)")
+	fs.IntVar(&opts.DataShards, "shards", job.DefaultDataShards, "data shards per playlist when --parity is set")
+	fs.IntVar(&opts.SymbolWidth, "width", job.DefaultSymbolWidth, "bits per track: 8, or up to 16 for fewer tracks and a larger dictionary")
+	opts.Dictionary = dictionaryFlags(fs)
+	fs.Func("channels", "playlist metadata that also stores data: description, cover, all or none (default none)", func(value string) error {
+		var err error
+		opts.Channels, err = job.ParseChannels(value)
+		return err
+	})
+	fs.StringVar(&opts.Visibility, "visibility", job.VisibilityPrivate, "who can see the playlists: private, public or collaborative")
+	fs.Func("encoding", "how tracks store data: substitution (one symbol per track) or permutation (the order of distinct tracks) (default substitution)", func(value string) error {
+		var err error
+		opts.Encoding, err = job.ParseEncoding(value)
+		return err
+	})
+
+	rest, code := parseCommand(fs, args, 1)
+	if code >= 0 {
+		return code
+	}
+	if opts.Encoding == job.EncodingPermutation && !flagSet(fs, "parity") {
+		// Permutations cannot be erasure coded, so they default to no
+		// parity rather than failing.
+		opts.ParityShards = 0
+	}
+	path := rest[0]
+	if name == "" {
+		name = filepath.Base(path)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := resolvePassword(&password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	opts.DictionaryCache = dictionaryCacheDir()
+	playlistID, err := job.Writer(client, path, password, name, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Println(playlistID)
+	return exitOK
+}
+
+func runGet(args []string) int {
+	var output, decoder, password string
+	var opts job.ReadOptions
+	fs := newFlagSet("get", "PLAYLIST_ID [-o FILE] [--decoder PATH]")
+	auth := authFlags(fs)
+	stringFlag(fs, &output, "output", "o", "", "file to restore the data to (defaults to the uploaded file name)")
+	decoderFlags(fs, &decoder, &opts.DecoderPassword)
+	passwordFlag(fs, &password)
+
+	rest, code := parseCommand(fs, args, 1)
+	if code >= 0 {
+		return code
+	}
+	if err := resolvePassword(&password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	opts.DictionaryCache = dictionaryCacheDir()
+	if err := job.Reader(rest[0], output, password, decoder, client, opts); err != nil {
+		return readFailure(err)
+	}
+	return exitOK
+}
+
+func runVerify(args []string) int {
+	var decoder, password string
+	opts := job.ReadOptions{VerifyOnly: true}
+	fs := newFlagSet("verify", "PLAYLIST_ID [--decoder PATH]")
+	auth := authFlags(fs)
+	decoderFlags(fs, &decoder, &opts.DecoderPassword)
+	passwordFlag(fs, &password)
+
+	rest, code := parseCommand(fs, args, 1)
+	if code >= 0 {
+		return code
+	}
+	if err := resolvePassword(&password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	opts.DictionaryCache = dictionaryCacheDir()
+	if err := job.Reader(rest[0], "", password, decoder, client, opts); err != nil {
+		return readFailure(err)
+	}
+	fmt.Println("OK")
+	return exitOK
+}
+
+func runLs(args []string) int {
+	var asJSON bool
+	fs := newFlagSet("ls", "[--json]")
+	auth := authFlags(fs)
+	fs.BoolVar(&asJSON, "json", false, "print the uploads as a JSON array")
+	if _, code := parseCommand(fs, args, 0); code >= 0 {
+		return code
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	uploads, err := job.List(context.Background(), client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if asJSON {
+		if uploads == nil {
+			uploads = []job.Upload{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(uploads); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return exitOK
+	}
+
+	fmt.Printf("%-24s %9s %9s  %-16s  %-13s  %s\n", "ID", "SIZE", "PLAYLISTS", "CREATED", "VISIBILITY", "NAME")
+	for _, u := range uploads {
+		// Uploads from before the head summarized them show dashes.
+		size, playlists, created := "-", "-", "-"
+		if u.Size > 0 {
+			size = formatSize(u.Size)
+		}
+		if u.Playlists > 0 {
+			playlists = strconv.Itoa(u.Playlists)
+		}
+		if !u.Created.IsZero() {
+			created = u.Created.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-24s %9s %9s  %-16s  %-13s  %s\n", u.ID, size, playlists, created, u.Visibility, u.Name)
+	}
+	fmt.Printf("%d upload(s)\n", len(uploads))
+	return exitOK
+}
+
+// formatSize prints a byte count with a binary unit, e.g. 1.5 MiB.
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		if value < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return ""
+}
+
+func runInfo(args []string) int {
+	fs := newFlagSet("info", "PLAYLIST_ID")
+	auth := authFlags(fs)
+	rest, code := parseCommand(fs, args, 1)
+	if code >= 0 {
+		return code
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	count, tracks := 0, 0
+	err := job.WalkChain(context.Background(), client, rest[0], func(p spotify.PlaylistDetails) error {
+		fmt.Printf("%-24s %6d tracks  %-13s  %s\n", p.ID, p.Tracks.Total, job.VisibilityOf(p), p.Name)
+		count++
+		tracks += p.Tracks.Total
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Printf("%d playlist(s), %d tracks\n", count, tracks)
+	return exitOK
+}
+
+func runRm(args []string) int {
+	var yes bool
+	var opts job.RemoveOptions
+	fs := newFlagSet("rm", "PLAYLIST_ID|JOURNAL [--dry-run] [--yes]")
+	auth := authFlags(fs)
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only list the playlists that would be removed")
+	fs.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	fs.BoolVar(&yes, "y", false, "shorthand for --yes")
+	rest, code := parseCommand(fs, args, 1)
+	if code >= 0 {
+		return code
+	}
+
+	// A journal file removes the playlists of an upload even when its chain
+	// was never finished.
+	playlistID := rest[0]
+	if stat, err := os.Stat(playlistID); err == nil && !stat.IsDir() {
+		opts.Journal, playlistID = playlistID, ""
+	}
+	if !yes && !opts.DryRun {
+		if !interactive() {
+			fmt.Fprintln(os.Stderr, "Refusing to remove playlists without confirmation, pass --yes")
+			return exitUsage
+		}
+		opts.Confirm = func(playlists int) bool {
+			var answer string
+			StringInput(fmt.Sprintf("Unfollow these %d playlist(s)? [y/N]: ", playlists), &answer, true)
+			return strings.EqualFold(strings.TrimSpace(answer), "y")
+		}
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	if err := job.Remove(client, playlistID, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runVisibility(args []string) int {
+	fs := newFlagSet("visibility", "PLAYLIST_ID private|public|collaborative")
+	auth := authFlags(fs)
+	rest, code := parseCommand(fs, args, 2)
+	if code >= 0 {
+		return code
+	}
+	if _, err := job.ParseVisibility(rest[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	if err := job.SetVisibility(client, rest[0], rest[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runRekey(args []string) int {
+	var password, newPassword string
+	fs := newFlagSet("rekey", "DECODER [--new-password PASSWORD]")
+	passwordFlag(fs, &password)
+	stringFlag(fs, &newPassword, "new-password", "", envNewPassword, "password to protect the decoder with from now on (defaults to the current one, which only upgrades the file format)")
+
+	rest, code := parseCommand(fs, args, 1)
+	if code >= 0 {
+		return code
+	}
+	path := rest[0]
+
+	before, err := crypto.EncryptedFileKDF(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := resolvePassword(&password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if newPassword == "" && interactive() {
+		StringInput("Enter the new password (empty keeps the current one): ", &newPassword, true)
+	}
+	if newPassword == "" {
+		newPassword = password
+	}
+
+	if err := crypto.Rekey(path, password, newPassword); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	after, err := crypto.EncryptedFileKDF(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Printf("Re-encrypted %s: %s -> %s\n", path, before, after)
+	return exitOK
+}
+
+func runDict(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: spotify-fs dict verify DECODER [--fix]")
+		return exitUsage
+	}
+
+	var password string
+	var fix bool
+	fs := newFlagSet("dict verify", "DECODER [--fix]")
+	auth := authFlags(fs)
+	passwordFlag(fs, &password)
+	fs.BoolVar(&fix, "fix", false, "record the tracks relinked entries now resolve to in the decoder file")
+
+	rest, code := parseCommand(fs, args[1:], 1)
+	if code >= 0 {
+		return code
+	}
+	path := rest[0]
+	if err := resolvePassword(&password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	dictionary, err := crypto.LoadDictionary(path, password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	client, code := connect(auth)
+	if code >= 0 {
+		return code
+	}
+
+	problems, err := crypto.VerifyDictionary(context.Background(), client, dictionary, dictionary.Spec.Market)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	broken, relinked := 0, 0
+	for _, p := range problems {
+		if p.Detail == "" {
+			fmt.Printf("%5d  %-10s  %s\n", p.Symbol, p.Problem, p.URI)
+		} else {
+			fmt.Printf("%5d  %-10s  %s (%s)\n", p.Symbol, p.Problem, p.URI, p.Detail)
+		}
+		if p.Problem == crypto.TrackRelinked {
+			relinked++
+			if fix {
+				dictionary.AddAlias(p.Detail, p.Symbol)
+			}
+		} else {
+			broken++
+		}
+	}
+	fmt.Printf("%d entries checked in market %s: %d missing or unplayable, %d relinked\n", len(dictionary.URIs), dictionary.Spec.Market, broken, relinked)
+
+	if fix && relinked > 0 {
+		if err := crypto.SaveDictionary(path, dictionary, password); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		fmt.Printf("Recorded %d relinked track(s) in %s\n", relinked, path)
+	}
+	if broken > 0 {
+		return exitCorrupt
+	}
+	return exitOK
+}
@@ -5,3 +5,5 @@ go 1.25.0
 require golang.org/x/oauth2 v0.34.0
 
 require golang.org/x/crypto v0.47.0
+
+require golang.org/x/sys v0.40.0 // indirect
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"spotifyfs/pkg/job"
+	"os"
+	"path/filepath"
+	"spotifyfs/pkg/crypto"
 	"spotifyfs/pkg/spotify"
 	"strings"
 	"time"
+
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -22,6 +28,20 @@ const (
 	tickerMs            = 200
 )
 
+const banner = ` 
+                                                                                                      
+ @@@@@@   @@@@@@@    @@@@@@   @@@@@@@  @@@  @@@@@@@@  @@@ @@@             @@@@@@@@   @@@@@@   
+@@@@@@@   @@@@@@@@  @@@@@@@@  @@@@@@@  @@@  @@@@@@@@  @@@ @@@             @@@@@@@@  @@@@@@@   
+!@@       @@!  @@@  @@!  @@@    @@!    @@!  @@!       @@! !@@             @@!       !@@       
+!@!       !@!  @!@  !@!  @!@    !@!    !@!  !@!       !@! @!!             !@!       !@!       
+!!@@!!    @!@@!@!   @!@  !@!    @!!    !!@  @!!!:!     !@!@!   @!@!@!@!@  @!!!:!    !!@@!!    
+ !!@!!!   !!@!!!    !@!  !!!    !!!    !!!  !!!!!:      @!!!   !!!@!@!!!  !!!!!:     !!@!!!   
+     !:!  !!:       !!:  !!!    !!:    !!:  !!:         !!:               !!:            !:!  
+    !:!   :!:       :!:  !:!    :!:    :!:  :!:         :!:               :!:           !:!   
+:::: ::    ::       ::::: ::     ::     ::   ::          ::                ::       :::: ::   
+:: : :     :         : :  :      :     :     :           :                 :        :: : :
+`
+
 func StringInput(question string, answer *string, optional bool) {
 	for {
 		fmt.Printf("%s", question)
@@ -34,27 +54,79 @@ func StringInput(question string, answer *string, optional bool) {
 	}
 }
 
-func initSpotify() (spotify.SpotifyClient, error) {
-	authStruct, err := spotify.NewAuthHandler()
+func tokenCachePath() (string, error) {
+	if path, ok := os.LookupEnv(envTokenCache); ok {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "spotify-fs", "token.bin"), nil
+}
+
+// dictionaryCacheDir is where generated dictionaries are kept. Setting the
+// environment variable to an empty string disables the cache.
+func dictionaryCacheDir() string {
+	if dir, ok := os.LookupEnv(envDictionaryCache); ok {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("Dictionary cache disabled: %v", err)
+		return ""
 	}
-	go authStruct.GenerateSpotifyAuthLink()
+	return filepath.Join(dir, "spotify-fs", "dictionaries")
+}
 
-	srv := spotify.NewHttpServer(authStruct)
-	go func(srv *http.Server) {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error starting server: %s", err)
+func headlessLogin(authStruct *spotify.AuthSpotify) error {
+	fmt.Printf("Open this URL on any device with a browser:\n%s\n", authStruct.AuthURL())
+	fmt.Println("After granting access the browser is redirected to a page that will probably fail to load.")
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("Paste the full URL from the address bar (or just the code): ")
+		line, err := reader.ReadString('\n')
+		if strings.TrimSpace(line) == "" {
+			if err != nil {
+				return fmt.Errorf("No redirect URL given: %w", err)
+			}
+			continue
+		}
+		if err := authStruct.ExchangeRedirect(context.Background(), line); err != nil {
+			fmt.Println(err)
+			continue
 		}
-	}(srv)
+		return nil
+	}
+}
 
-	var timeout bool
+func browserLogin(authStruct *spotify.AuthSpotify, listenAddr string) error {
+	srv := spotify.NewHttpServer(authStruct, listenAddr)
+	// Binding before the link is shown lets a busy address fail the login
+	// instead of leaving the browser nowhere to return to.
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("Error starting server: %w", err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	authStruct.GenerateSpotifyAuthLink()
+
+	var loginErr error
 	select {
 	case <-authStruct.Done:
 		fmt.Println("Token recived, shuting down server...")
+	case err := <-serveErr:
+		loginErr = fmt.Errorf("Error running server: %w", err)
 	case <-time.After(1 * time.Minute):
 		fmt.Println("Timeout, shuting down server...")
-		timeout = true
+		loginErr = fmt.Errorf("Server shut down due to inactivity (timeout).")
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -65,11 +137,62 @@ func initSpotify() (spotify.SpotifyClient, error) {
 		fmt.Println("Server is shutdown")
 	}
 
-	if timeout {
-		return spotify.SpotifyClient{}, fmt.Errorf("Server shut down due to inactivity (timeout).")
+	return loginErr
+}
+
+func initSpotify(opts authOptions) (spotify.SpotifyClient, error) {
+	authStruct, err := spotify.NewAuthHandler(opts.redirectURL)
+	if err != nil {
+		return spotify.SpotifyClient{}, err
 	}
 
-	ctx = context.Background()
+	ctx := context.Background()
+	secret := authStruct.Config.ClientSecret
+	cachePath, err := tokenCachePath()
+	if err != nil {
+		log.Printf("Token cache disabled: %v", err)
+	}
+	// scopes are those granted to the token being used.
+	var scopes []string
+	saveToken := func(token *oauth2.Token) error {
+		if cachePath == "" {
+			return nil
+		}
+		scopes = spotify.GrantedScopes(token, scopes)
+		return crypto.SaveToken(cachePath, token, scopes, secret)
+	}
+
+	if cachePath != "" {
+		if token, granted, err := crypto.LoadToken(cachePath, secret); err == nil {
+			if missing := spotify.MissingScopes(authStruct.Config.Scopes, granted); len(missing) > 0 {
+				log.Printf("Cached token lacks the %s permissions, authenticating again", strings.Join(missing, ", "))
+			} else {
+				scopes = granted
+				source := spotify.NewPersistentTokenSource(ctx, authStruct.Config, token, saveToken)
+				if _, err := source.Token(); err == nil {
+					authStruct.Token = token
+					authStruct.TokenSource = source
+				} else {
+					log.Printf("Cached token could not be refreshed, authenticating again: %v", err)
+				}
+			}
+		}
+	}
+
+	if authStruct.TokenSource == nil {
+		scopes = authStruct.Config.Scopes
+		login := func() error { return browserLogin(authStruct, opts.listenAddr) }
+		if opts.headless {
+			login = func() error { return headlessLogin(authStruct) }
+		}
+		if err := login(); err != nil {
+			return spotify.SpotifyClient{}, err
+		}
+		if err := saveToken(authStruct.Token); err != nil {
+			log.Printf("Error caching token: %v", err)
+		}
+		authStruct.TokenSource = spotify.NewPersistentTokenSource(ctx, authStruct.Config, authStruct.Token, saveToken)
+	}
 
 	ticker := time.NewTicker(tickerMs * time.Millisecond)
 	webConfig := spotify.WebClient{
@@ -77,6 +200,7 @@ func initSpotify() (spotify.SpotifyClient, error) {
 			Client:      &http.Client{Timeout: 10 * time.Second},
 			RateLimiter: ticker,
 		},
+		Retry:            spotify.DefaultRetryPolicy,
 		SpotifySearchURL: "https://api.spotify.com/v1/search",
 		SpotifyUserURL:   "https://api.spotify.com/v1/me",
 
@@ -85,6 +209,10 @@ func initSpotify() (spotify.SpotifyClient, error) {
 		PlaylistURL:           "https://api.spotify.com/v1/playlists/%s/tracks",
 		ChangePlaylistDetails: "https://api.spotify.com/v1/playlists/%s",
 		GetPlaylist:           "https://api.spotify.com/v1/playlists/%s",
+		UnfollowPlaylistURL:   "https://api.spotify.com/v1/playlists/%s/followers",
+		TracksURL:             "https://api.spotify.com/v1/tracks",
+		PlaylistImagesURL:     "https://api.spotify.com/v1/playlists/%s/images",
+		MyPlaylistsURL:        "https://api.spotify.com/v1/me/playlists",
 	}
 
 	client := spotify.SpotifyClient{
@@ -101,64 +229,5 @@ func initSpotify() (spotify.SpotifyClient, error) {
 }
 
 func main() {
-
-	fmt.Printf(` 
-                                                                                                      
- @@@@@@   @@@@@@@    @@@@@@   @@@@@@@  @@@  @@@@@@@@  @@@ @@@             @@@@@@@@   @@@@@@   
-@@@@@@@   @@@@@@@@  @@@@@@@@  @@@@@@@  @@@  @@@@@@@@  @@@ @@@             @@@@@@@@  @@@@@@@   
-!@@       @@!  @@@  @@!  @@@    @@!    @@!  @@!       @@! !@@             @@!       !@@       
-!@!       !@!  @!@  !@!  @!@    !@!    !@!  !@!       !@! @!!             !@!       !@!       
-!!@@!!    @!@@!@!   @!@  !@!    @!!    !!@  @!!!:!     !@!@!   @!@!@!@!@  @!!!:!    !!@@!!    
- !!@!!!   !!@!!!    !@!  !!!    !!!    !!!  !!!!!:      @!!!   !!!@!@!!!  !!!!!:     !!@!!!   
-     !:!  !!:       !!:  !!!    !!:    !!:  !!:         !!:               !!:            !:!  
-    !:!   :!:       :!:  !:!    :!:    :!:  :!:         :!:               :!:           !:!   
-:::: ::    ::       ::::: ::     ::     ::   ::          ::                ::       :::: ::   
-:: : :     :         : :  :      :     :     :           :                 :        :: : :
-
-
-		`)
-
-	var option int
-	for {
-		fmt.Printf("Would you like to:\n1) Write file to Playlist\n2) Read file from Playlist\nAnswer:")
-		fmt.Scanln(&option)
-		if option > 2 {
-			fmt.Println("Invalid option... Try again")
-			continue
-		}
-		break
-	}
-
-	var secretKey string
-	StringInput("Enter password to use as a seed: ", &secretKey, false)
-
-	var filepath string
-	var playlistName string
-	var playlistID string
-	var gobFilePath string
-	switch option {
-	case 1:
-		StringInput("Enter the filepath of the file you would like to store: ", &filepath, false)
-		StringInput("Enter a name for the Playlist: ", &playlistName, false)
-		client, err := initSpotify()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		job.Writer(&client, filepath, secretKey, playlistName)
-
-	case 2:
-		StringInput("Enter playlist ID: ", &playlistID, false)
-		StringInput("Enter a name for the file to be restored, including the extension: ", &filepath, false)
-		StringInput("Path to the decoder file (Optional, but recommended): ", &gobFilePath, true)
-		client, err := initSpotify()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		job.Reader(playlistID, filepath, secretKey, gobFilePath, &client)
-
-	default:
-	}
-
+	os.Exit(run(os.Args[1:]))
 }
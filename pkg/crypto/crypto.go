@@ -2,25 +2,18 @@ package crypto
 
 import (
 	"bytes"
-	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	mathRand "math/rand/v2"
-	"net/http"
 	"os"
-	spotify "spotifyfs/pkg/spotify"
+	"path/filepath"
 	"strings"
-
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -29,97 +22,361 @@ const (
 	saltSize        = 16
 	keySize         = 32
 	pbkdfIterations = 100000
+	gcmNonceSize    = 12
+
+	EncryptedMagic   = "SPFK"
+	EncryptedVersion = 1
+	kdfIDPBKDF2      = 1
+	kdfIDArgon2id    = 2
 )
 
-func SaveMap(path string, m map[string]byte, password string) error {
+// Dictionary maps symbols of Width bits to track URIs. With Spec.Homophones
+// above one every symbol has that many tracks, entries
+// symbol*Homophones to symbol*Homophones+Homophones-1, and any of them
+// decodes to it. Dictionaries of any width generated from the same password
+// and Spec share their first 256 symbols, so a wide dictionary also decodes
+// what was written with 8-bit symbols.
+type Dictionary struct {
+	Width int
+	URIs  []string
+	// Spec is how the dictionary was searched for.
+	Spec DictionarySpec
+	// Aliases are other URIs that decode to a symbol, e.g. the tracks
+	// Spotify relinked entries to.
+	Aliases map[string]uint16
+
+	symbols map[string]uint16
+}
+
+func newDictionary(width int, spec DictionarySpec, uris []string) *Dictionary {
+	d := &Dictionary{Width: width, URIs: uris, Spec: spec, symbols: make(map[string]uint16, len(uris))}
+	homophones := spec.homophones()
+	for entry, uri := range uris {
+		d.symbols[uri] = uint16(entry / homophones)
+	}
+	return d
+}
+
+// URI returns the track of symbol, picked at random among its homophones so
+// that repeated symbols do not show as repeated tracks.
+func (d *Dictionary) URI(symbol uint16) string {
+	homophones := d.Spec.homophones()
+	if homophones == 1 {
+		return d.URIs[symbol]
+	}
+	return d.URIs[int(symbol)*homophones+mathRand.IntN(homophones)]
+}
+
+// Symbol returns the symbol of uri, or of the entry uri is an alias of, which
+// must be below 1<<width to be valid for symbols of the given width.
+func (d *Dictionary) Symbol(uri string, width int) (uint16, bool) {
+	symbol, ok := d.symbols[uri]
+	if !ok {
+		symbol, ok = d.Aliases[uri]
+	}
+	if !ok || int(symbol) >= 1<<width {
+		return 0, false
+	}
+	return symbol, true
+}
+
+// Entries returns the entries of the symbols below 1<<width.
+func (d *Dictionary) Entries(width int) []string {
+	return d.URIs[:min(len(d.URIs), d.Spec.homophones()<<width)]
+}
+
+// EntrySymbol is the symbol entry i of URIs stands for.
+func (d *Dictionary) EntrySymbol(i int) uint16 {
+	return uint16(i / d.Spec.homophones())
+}
+
+// savedDictionary is the gob layout of decoder files. Files from before
+// symbol widths existed hold a plain map[string]byte instead, and files from
+// before specs a Version.
+type savedDictionary struct {
+	Width   int
+	URIs    []string
+	Version int
+	Aliases map[string]uint16
+	Spec    *DictionarySpec
+}
+
+// AddAlias makes uri decode to symbol too. URIs that already are entries
+// are left alone.
+func (d *Dictionary) AddAlias(uri string, symbol uint16) {
+	if _, ok := d.symbols[uri]; ok {
+		return
+	}
+	if d.Aliases == nil {
+		d.Aliases = make(map[string]uint16)
+	}
+	d.Aliases[uri] = symbol
+}
+
+func SaveDictionary(path string, d *Dictionary, password string) error {
 	var gobBuffer bytes.Buffer
-	if err := gob.NewEncoder(&gobBuffer).Encode(m); err != nil {
+	if err := gob.NewEncoder(&gobBuffer).Encode(savedDictionary{Width: d.Width, URIs: d.URIs, Aliases: d.Aliases, Spec: &d.Spec}); err != nil {
 		return err
 	}
-	plaintext := gobBuffer.Bytes()
 
-	salt := make([]byte, saltSize)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return err
+	return SaveEncrypted(path, gobBuffer.Bytes(), password, 0644)
+}
+
+func LoadDictionary(path, password string) (*Dictionary, error) {
+	plaintext, err := LoadEncrypted(path, password)
+	if err != nil {
+		return nil, err
 	}
 
-	key := pbkdf2.Key([]byte(password), salt, pbkdfIterations, keySize, sha256.New)
+	var saved savedDictionary
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&saved); err == nil {
+		spec := SequentialDictionarySpec()
+		if saved.Spec != nil {
+			spec = *saved.Spec
+		} else if spec, err = DictionarySpecVersion(saved.Version); err != nil {
+			return nil, err
+		}
+		if saved.Width < 8 || saved.Width > 16 || len(saved.URIs) != spec.homophones()<<saved.Width {
+			return nil, fmt.Errorf("Decoder file %s holds %d entries for %d-bit symbols", path, len(saved.URIs), saved.Width)
+		}
+		d := newDictionary(saved.Width, spec, saved.URIs)
+		d.Aliases = saved.Aliases
+		return d, nil
+	}
 
-	block, err := aes.NewCipher(key)
+	var legacy map[string]byte
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&legacy); err != nil {
+		return nil, err
+	}
+	uris := make([]string, 256)
+	for uri, b := range legacy {
+		uris[b] = uri
+	}
+	return newDictionary(8, SequentialDictionarySpec(), uris), nil
+}
+
+// SaveEncrypted writes plaintext to path sealed with AES-GCM under a key
+// derived from password, behind a header naming the key derivation and its
+// parameters:
+//
+//	"SPFK" | version | kdf id | iterations u32 | memory u32 | threads u8 |
+//	salt length u8 | salt | nonce | ciphertext
+//
+// The header is authenticated along with the ciphertext. The file is written
+// aside and renamed over path, so that a crash or a concurrent save never
+// leaves it truncated.
+func SaveEncrypted(path string, plaintext []byte, password string, perm os.FileMode) error {
+	kdf, err := NewKDFParams()
+	if err != nil {
+		return err
+	}
+	key, err := kdf.Key(password)
 	if err != nil {
 		return err
 	}
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return err
 	}
 	nonce := make([]byte, gcm.NonceSize())
-	io.ReadFull(rand.Reader, nonce)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
 
-	ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
+	header, err := encryptedHeader(kdf, nonce)
+	if err != nil {
+		return err
+	}
+	ciphertext := gcm.Seal(nil, nonce, plaintext, header)
 
-	file, err := os.Create(path)
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	tmp := file.Name()
+	defer os.Remove(tmp)
 	defer file.Close()
 
-	file.Write(salt)
-	file.Write(nonce)
-	file.Write(ciphertext)
+	if err := file.Chmod(perm); err != nil {
+		return err
+	}
+	for _, part := range [][]byte{header, ciphertext} {
+		if _, err := file.Write(part); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
 
-	return nil
+func LoadEncrypted(path, password string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
+	if !bytes.HasPrefix(data, []byte(EncryptedMagic)) {
+		return loadLegacy(data, password)
+	}
+	plaintext, err := loadVersioned(data, password)
+	if err != nil {
+		// A headerless file has a random salt, which may start with the
+		// magic by chance.
+		if legacy, legacyErr := loadLegacy(data, password); legacyErr == nil {
+			return legacy, nil
+		}
+	}
+	return plaintext, err
 }
 
-func LoadMap(path, password string) (map[string]byte, error) {
+// EncryptedFileKDF reports the key derivation protecting a file written by
+// SaveEncrypted.
+func EncryptedFileKDF(path string) (KDFParams, error) {
 	data, err := os.ReadFile(path)
+	if err != nil {
+		return KDFParams{}, err
+	}
+	if !bytes.HasPrefix(data, []byte(EncryptedMagic)) {
+		if len(data) < saltSize {
+			return KDFParams{}, errors.New("corrupted or too short file")
+		}
+		return legacyKDFParams(data[:saltSize]), nil
+	}
+	kdf, _, _, err := parseEncryptedHeader(data)
+	return kdf, err
+}
+
+// Rekey re-encrypts the file at path under newPassword, with the current
+// key derivation, replacing it only once the new file is written.
+func Rekey(path, oldPassword, newPassword string) error {
+	plaintext, err := LoadEncrypted(path, oldPassword)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return SaveEncrypted(path, plaintext, newPassword, info.Mode().Perm())
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
+
+func encryptedHeader(kdf KDFParams, nonce []byte) ([]byte, error) {
+	var id byte
+	switch kdf.KDF {
+	case KDFPBKDF2:
+		id = kdfIDPBKDF2
+	case KDFArgon2id:
+		id = kdfIDArgon2id
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation %q", kdf.KDF)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(EncryptedMagic)
+	buf.WriteByte(EncryptedVersion)
+	buf.WriteByte(id)
+	binary.Write(&buf, binary.BigEndian, uint32(kdf.Iterations))
+	binary.Write(&buf, binary.BigEndian, kdf.Memory)
+	buf.WriteByte(kdf.Threads)
+	buf.WriteByte(byte(len(kdf.Salt)))
+	buf.Write(kdf.Salt)
+	buf.Write(nonce)
+	return buf.Bytes(), nil
+}
+
+// parseEncryptedHeader returns the key derivation, the nonce and the length
+// of the header at the start of data.
+func parseEncryptedHeader(data []byte) (KDFParams, []byte, int, error) {
+	const fixed = len(EncryptedMagic) + 1 + 1 + 4 + 4 + 1 + 1
+	if len(data) < fixed {
+		return KDFParams{}, nil, 0, errors.New("corrupted or too short file")
+	}
+	if version := data[len(EncryptedMagic)]; version != EncryptedVersion {
+		return KDFParams{}, nil, 0, fmt.Errorf("Unsupported encrypted file version %d", version)
+	}
+
+	var kdf KDFParams
+	switch id := data[len(EncryptedMagic)+1]; id {
+	case kdfIDPBKDF2:
+		kdf.KDF = KDFPBKDF2
+	case kdfIDArgon2id:
+		kdf.KDF = KDFArgon2id
+	default:
+		return KDFParams{}, nil, 0, fmt.Errorf("Unknown key derivation id %d", id)
+	}
+	offset := len(EncryptedMagic) + 2
+	kdf.Iterations = int(binary.BigEndian.Uint32(data[offset:]))
+	kdf.Memory = binary.BigEndian.Uint32(data[offset+4:])
+	kdf.Threads = data[offset+8]
+	saltLength := int(data[offset+9])
+
+	end := fixed + saltLength + gcmNonceSize
+	if len(data) < end {
+		return KDFParams{}, nil, 0, errors.New("corrupted or too short file")
+	}
+	kdf.Salt = data[fixed : fixed+saltLength]
+	if err := kdf.validate(); err != nil {
+		return KDFParams{}, nil, 0, err
+	}
+	return kdf, data[fixed+saltLength : end], end, nil
+}
 
-	block, err := aes.NewCipher(make([]byte, keySize))
+func loadVersioned(data []byte, password string) ([]byte, error) {
+	kdf, nonce, headerLength, err := parseEncryptedHeader(data)
 	if err != nil {
 		return nil, err
 	}
-	gcmTemp, err := cipher.NewGCM(block)
+	key, err := kdf.Key(password)
 	if err != nil {
 		return nil, err
 	}
-	nonceSize := gcmTemp.NonceSize()
+	return openSealed(key, nonce, data[headerLength:], data[:headerLength])
+}
 
-	if len(data) < saltSize+nonceSize {
+// loadLegacy reads the headerless salt||nonce||ciphertext layout.
+func loadLegacy(data []byte, password string) ([]byte, error) {
+	if len(data) < saltSize+gcmNonceSize {
 		return nil, errors.New("corrupted or too short file")
 	}
 
 	salt := data[:saltSize]
-	nonce := data[saltSize : saltSize+nonceSize]
-	ciphertext := data[saltSize+nonceSize:]
+	nonce := data[saltSize : saltSize+gcmNonceSize]
+	ciphertext := data[saltSize+gcmNonceSize:]
 
-	key := pbkdf2.Key([]byte(password), salt, pbkdfIterations, keySize, sha256.New)
-
-	block, err = aes.NewCipher(key)
+	key, err := legacyKDFParams(salt).Key(password)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return openSealed(key, nonce, ciphertext, nil)
+}
+
+func openSealed(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
-
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, errors.New("Decryption failed: incorrect password or altered data.")
 	}
-
-	var result map[string]byte
-	reader := bytes.NewReader(plaintext)
-	err = gob.NewDecoder(reader).Decode(&result)
-
-	return result, err
+	return plaintext, nil
 }
 
-func NewRNGStringWithSeed(length int, hash []byte, modifier uint64) string {
+func NewRNGStringWithSeed(length int, charset string, hash []byte, modifier uint64) string {
 	baseSeed := binary.BigEndian.Uint64(hash)
 
 	seed := baseSeed + modifier
@@ -131,92 +388,8 @@ func NewRNGStringWithSeed(length int, hash []byte, modifier uint64) string {
 	sb.Grow(length)
 
 	for i := 0; i < length; i++ {
-		randomIndex := r.IntN(len(Charset))
-		sb.WriteByte(Charset[randomIndex])
+		randomIndex := r.IntN(len(charset))
+		sb.WriteByte(charset[randomIndex])
 	}
 	return sb.String()
 }
-
-func NewDictionary(ctx context.Context, password string, s *spotify.SpotifyClient) (map[byte]string, map[string]byte, error) {
-	h := sha256.New()
-	h.Write([]byte(password))
-	hash := h.Sum(nil)
-
-	foundCount := 0
-	byteCount := byte(0)
-	seedDiff := uint64(0)
-	writerDictionary := make(map[byte]string, 256)
-	readerDictionary := make(map[string]byte, 256)
-
-	if len(hash) < 8 {
-		return nil, nil, fmt.Errorf("Hash has less than 8 bytes")
-	}
-
-	for foundCount <= 255 {
-		err := func() error {
-			searchString := NewRNGStringWithSeed(LengthRNGString, hash[:8], seedDiff)
-
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.WebConfig.SpotifySearchURL, nil)
-			if err != nil {
-				log.Printf("Error creating the request: %s\n Trying Again...", err)
-				return nil
-			}
-
-			req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
-
-			query := req.URL.Query()
-			query.Add("q", searchString)
-			query.Add("type", "track")
-			query.Add("limit", "1")
-			query.Add("market", "US")
-
-			req.URL.RawQuery = query.Encode()
-
-			resp, err := s.WebConfig.Client.Do(req)
-			if err != nil {
-				if ctx.Err() != nil {
-					return fmt.Errorf("Error with context: %s", ctx.Err().Error())
-				}
-				log.Printf("Error executing the request: %s\n Trying Again...", err)
-				return nil
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("Unexpected status: %d\n Trying Again...", resp.StatusCode)
-				return nil
-			}
-
-			var response spotify.SpotifySearchResponse
-			err = json.NewDecoder(resp.Body).Decode(&response)
-			if err != nil {
-				log.Printf("Error reading JSON: %v\n Trying Again...", err)
-				return nil
-			}
-
-			if len(response.Tracks.Items) > 0 {
-
-				if _, alreadyExists := readerDictionary[response.Tracks.Items[0].URI]; alreadyExists {
-					log.Printf("Collision detected for track %s. Trying another one...", response.Tracks.Items[0].URI)
-					return nil
-				}
-
-				writerDictionary[byteCount] = response.Tracks.Items[0].URI
-				readerDictionary[response.Tracks.Items[0].URI] = byteCount
-				byteCount++
-				foundCount++
-			}
-
-			return nil
-		}()
-		log.Printf("Track %d/256\n", foundCount)
-
-		seedDiff++
-
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-
-	return writerDictionary, readerDictionary, nil
-}
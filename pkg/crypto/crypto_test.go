@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// saveLegacy writes plaintext in the headerless salt||nonce||ciphertext
+// layout used before the key derivation was recorded.
+func saveLegacy(t *testing.T, path string, plaintext []byte, password string, salt []byte) {
+	t.Helper()
+	key, err := legacyKDFParams(salt).Key(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Repeat([]byte{7}, gcmNonceSize)
+	data := append(append(bytes.Clone(salt), nonce...), gcm.Seal(nil, nonce, plaintext, nil)...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	plaintext := []byte("decoder")
+
+	versioned := filepath.Join(dir, "versioned")
+	if err := SaveEncrypted(versioned, plaintext, "password", 0600); err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(dir, "legacy")
+	saveLegacy(t, legacy, plaintext, "password", bytes.Repeat([]byte{1}, saltSize))
+	// A legacy salt may start with the magic by chance.
+	magicSalt := filepath.Join(dir, "magic-salt")
+	saveLegacy(t, magicSalt, plaintext, "password", append([]byte(EncryptedMagic), bytes.Repeat([]byte{1}, saltSize-len(EncryptedMagic))...))
+
+	tests := []struct {
+		path string
+		kdf  string
+	}{
+		{versioned, KDFArgon2id},
+		{legacy, KDFPBKDF2},
+		{magicSalt, KDFPBKDF2},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			got, err := LoadEncrypted(tt.path, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("Loaded %q, want %q", got, plaintext)
+			}
+			if _, err := LoadEncrypted(tt.path, "wrong"); err == nil {
+				t.Fatal("Loaded with the wrong password")
+			}
+			if tt.path == magicSalt {
+				return
+			}
+			kdf, err := EncryptedFileKDF(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kdf.KDF != tt.kdf {
+				t.Fatalf("Got KDF %s, want %s", kdf.KDF, tt.kdf)
+			}
+		})
+	}
+}
+
+func testURIs(n int) []string {
+	uris := make([]string, n)
+	for i := range uris {
+		uris[i] = fmt.Sprintf("spotify:track:%022d", i)
+	}
+	return uris
+}
+
+func TestLoadDictionary(t *testing.T) {
+	dir := t.TempDir()
+
+	// Legacy decoders are a map[string]byte in the headerless layout.
+	legacyMap := make(map[string]byte, 256)
+	for i, uri := range testURIs(256) {
+		legacyMap[uri] = byte(i)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(legacyMap); err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(dir, "legacy.gob")
+	saveLegacy(t, legacy, buf.Bytes(), "password", bytes.Repeat([]byte{3}, saltSize))
+
+	spec := DefaultDictionarySpec()
+	spec.Homophones = 2
+	versioned := filepath.Join(dir, "versioned.gob")
+	if err := SaveDictionary(versioned, newDictionary(8, spec, testURIs(512)), "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path       string
+		homophones int
+	}{
+		{legacy, 1},
+		{versioned, 2},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			d, err := LoadDictionary(tt.path, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Width != 8 || len(d.URIs) != 256*tt.homophones {
+				t.Fatalf("Got %d entries for width %d", len(d.URIs), d.Width)
+			}
+			for i, uri := range testURIs(256 * tt.homophones) {
+				want := uint16(i / tt.homophones)
+				if symbol, ok := d.Symbol(uri, 8); !ok || symbol != want {
+					t.Fatalf("%s decodes to %d, %v, want %d", uri, symbol, ok, want)
+				}
+			}
+			for symbol := range 256 {
+				if got, _ := d.Symbol(d.URI(uint16(symbol)), 8); got != uint16(symbol) {
+					t.Fatalf("URI(%d) decodes to %d", symbol, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package crypto
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	spotify "spotifyfs/pkg/spotify"
+	"strings"
+	"sync"
+)
+
+const (
+	// searchResults is the most results one search returns.
+	searchResults = 50
+	// searchWorkers is how many searches run at once. Results are still
+	// consumed in query order, so the dictionary does not depend on it.
+	searchWorkers = 8
+	// maxQueriesPerPage bounds the searches run for a dictionary, as a
+	// multiple of how many it would take if every result were new, so that
+	// a spec whose searches stop finding new tracks fails instead of
+	// searching forever.
+	maxQueriesPerPage = 10
+	// cacheSaltFile holds the salt cache file names are derived with.
+	cacheSaltFile = "salt"
+)
+
+type DictionaryOptions struct {
+	// Width is the symbol width, 8 to 16 bits.
+	Width int
+	Spec  DictionarySpec
+	// CacheDir keeps generated dictionaries so that they are only searched
+	// for once per password. "" disables the cache.
+	CacheDir string
+}
+
+// NewDictionary searches for 1<<opts.Width distinct tracks per homophone, in
+// an order that only depends on the password and opts.Spec. A cached
+// dictionary at least as wide is returned instead when there is one.
+func NewDictionary(ctx context.Context, password string, s *spotify.SpotifyClient, opts DictionaryOptions) (*Dictionary, error) {
+	if opts.Width < 8 || opts.Width > 16 {
+		return nil, fmt.Errorf("Unsupported symbol width %d, expected 8 to 16 bits", opts.Width)
+	}
+	if err := opts.Spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	seed := sha256.Sum256([]byte(password))
+
+	cachePath := ""
+	if opts.CacheDir != "" {
+		id, err := dictionaryCacheID(opts.CacheDir, password, opts.Spec)
+		if err != nil {
+			log.Printf("Cannot use the dictionary cache: %v", err)
+		} else {
+			cachePath = filepath.Join(opts.CacheDir, id+".gob")
+			d, err := LoadDictionary(cachePath, password)
+			if err == nil && d.Width >= opts.Width && d.Spec == opts.Spec {
+				log.Printf("Using the cached dictionary %s", cachePath)
+				return d, nil
+			}
+		}
+	}
+
+	uris, err := searchTracks(ctx, s, seed[:8], opts.Spec.homophones()<<opts.Width, opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+	d := newDictionary(opts.Width, opts.Spec, uris)
+
+	if cachePath != "" {
+		if err := saveCachedDictionary(cachePath, d, password); err != nil {
+			log.Printf("Cannot cache the dictionary: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// searchTracks collects size distinct tracks from the results spec takes of
+// the searches seeded by seed, in query order. searchWorkers searches are
+// kept in flight; rate limits are left to the client, which waits as long as
+// Retry-After asks. It gives up after maxQueriesPerPage times the searches
+// size needs.
+func searchTracks(ctx context.Context, s *spotify.SpotifyClient, seed []byte, size int, spec DictionarySpec) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type page struct {
+		uris []string
+		err  error
+	}
+	var pending []chan page
+	query := uint64(0)
+	search := func() {
+		results := make(chan page, 1)
+		q := spec.query(seed, query)
+		go func() {
+			response, err := s.Search(ctx, q, spec.Market, spec.Results, spec.Offset)
+			var uris []string
+			for _, item := range response.Tracks.Items {
+				uris = append(uris, item.URI)
+			}
+			results <- page{uris: uris, err: err}
+		}()
+		pending = append(pending, results)
+		query++
+	}
+
+	budget := uint64(maxQueriesPerPage * ((size + spec.Results - 1) / spec.Results))
+	uris := make([]string, 0, size)
+	seen := make(map[string]bool, size)
+	for len(uris) < size {
+		for len(pending) < searchWorkers && query < budget {
+			search()
+		}
+		if len(pending) == 0 {
+			return nil, fmt.Errorf("Dictionary searches (%s) stopped finding new tracks: %d of %d found after %d queries", spec, len(uris), size, query)
+		}
+		var p page
+		select {
+		case p = <-pending[0]:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		pending = pending[1:]
+		if p.err != nil {
+			return nil, fmt.Errorf("Error searching tracks: %w", p.err)
+		}
+
+		before := len(uris)
+		for _, uri := range p.uris {
+			if seen[uri] {
+				continue
+			}
+			uris = append(uris, uri)
+			seen[uri] = true
+			if len(uris) == size {
+				break
+			}
+		}
+		if len(uris) > before && (size == 256 || len(uris)/256 > before/256) {
+			log.Printf("Track %d/%d\n", len(uris), size)
+		}
+	}
+	return uris, nil
+}
+
+// dictionaryCacheID names the cache file of a password and spec. The name is
+// keyed with Argon2id and the salt of the cache directory, so that guessing
+// the password from it costs as much as guessing it from the encrypted file.
+func dictionaryCacheID(dir, password string, spec DictionarySpec) (string, error) {
+	salt, err := cacheSalt(dir)
+	if err != nil {
+		return "", err
+	}
+	kdf := KDFParams{KDF: KDFArgon2id, Iterations: argon2Time, Memory: argon2Memory, Threads: argon2Threads, Salt: salt}
+	key, err := kdf.Key(password)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("spotifyfs dictionary cache\x00"))
+	json.NewEncoder(mac).Encode(spec)
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// cacheSalt returns the random salt of the cache in dir, creating it on
+// first use.
+func cacheSalt(dir string) ([]byte, error) {
+	path := filepath.Join(dir, cacheSaltFile)
+	salt, err := os.ReadFile(path)
+	if err == nil {
+		if len(salt) != saltSize {
+			return nil, fmt.Errorf("Corrupted dictionary cache salt %s", path)
+		}
+		return salt, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		// Another process created it first.
+		return cacheSalt(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Write(salt); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return salt, file.Close()
+}
+
+func saveCachedDictionary(path string, d *Dictionary, password string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return SaveDictionary(path, d, password)
+}
+
+const (
+	// TrackMissing entries match no track of the catalog any more.
+	TrackMissing = "missing"
+	// TrackUnplayable entries exist but cannot be played in the market.
+	TrackUnplayable = "unplayable"
+	// TrackRelinked entries resolve to another track in the market.
+	TrackRelinked = "relinked"
+)
+
+// TrackProblem is an entry of a dictionary that no longer resolves to the
+// track it was generated with.
+type TrackProblem struct {
+	Symbol  uint16
+	URI     string
+	Problem string
+	// Detail is the URI a relinked entry resolves to, or why an entry is
+	// not playable.
+	Detail string
+}
+
+// VerifyDictionary looks every entry of d up in the given market and returns
+// the ones that are missing, unplayable or relinked, in symbol order.
+func VerifyDictionary(ctx context.Context, s *spotify.SpotifyClient, d *Dictionary, market string) ([]TrackProblem, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := (len(d.URIs) + spotify.SpotifyMaxTracksPerLookup - 1) / spotify.SpotifyMaxTracksPerLookup
+	found := make([][]TrackProblem, batches)
+	starts := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for w := 0; w < searchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				problems, err := verifyBatch(ctx, s, d, start, market)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				found[start/spotify.SpotifyMaxTracksPerLookup] = problems
+			}
+		}()
+	}
+
+	for b := 0; b < batches && ctx.Err() == nil; b++ {
+		starts <- b * spotify.SpotifyMaxTracksPerLookup
+	}
+	close(starts)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []TrackProblem
+	for _, batch := range found {
+		problems = append(problems, batch...)
+	}
+	return problems, nil
+}
+
+func verifyBatch(ctx context.Context, s *spotify.SpotifyClient, d *Dictionary, start int, market string) ([]TrackProblem, error) {
+	end := min(start+spotify.SpotifyMaxTracksPerLookup, len(d.URIs))
+	var problems []TrackProblem
+	var ids []string
+	var entries []int
+	for entry := start; entry < end; entry++ {
+		id, ok := strings.CutPrefix(d.URIs[entry], "spotify:track:")
+		if !ok || id == "" {
+			problems = append(problems, TrackProblem{Symbol: d.EntrySymbol(entry), URI: d.URIs[entry], Problem: TrackMissing})
+			continue
+		}
+		ids = append(ids, id)
+		entries = append(entries, entry)
+	}
+	if len(ids) == 0 {
+		return problems, nil
+	}
+
+	tracks, err := s.GetTracks(ctx, ids, market)
+	if err != nil {
+		return nil, err
+	}
+	for i, track := range tracks {
+		problem := TrackProblem{Symbol: d.EntrySymbol(entries[i]), URI: d.URIs[entries[i]]}
+		switch {
+		case track == nil:
+			problem.Problem = TrackMissing
+		case track.IsPlayable != nil && !*track.IsPlayable:
+			problem.Problem = TrackUnplayable
+			if track.Restrictions != nil {
+				problem.Detail = track.Restrictions.Reason
+			}
+		case track.URI != problem.URI:
+			problem.Problem = TrackRelinked
+			problem.Detail = track.URI
+		default:
+			continue
+		}
+		problems = append(problems, problem)
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Symbol < problems[j].Symbol })
+	return problems, nil
+}
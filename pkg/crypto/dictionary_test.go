@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"spotifyfs/pkg/spotify/spotifytest"
+	"strings"
+	"testing"
+)
+
+func TestDictionaryCacheID(t *testing.T) {
+	dir := t.TempDir()
+	spec := DefaultDictionarySpec()
+	id, err := dictionaryCacheID(dir, "password", spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, cacheSaltFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Salt has mode %v, want 0600", perm)
+	}
+
+	again, err := dictionaryCacheID(dir, "password", spec)
+	if err != nil || again != id {
+		t.Fatalf("Second ID is %s, %v, want %s", again, err, id)
+	}
+
+	otherSpec := spec
+	otherSpec.Market = "SE"
+	for name, other := range map[string]func() (string, error){
+		"password": func() (string, error) { return dictionaryCacheID(dir, "other", spec) },
+		"spec":     func() (string, error) { return dictionaryCacheID(dir, "password", otherSpec) },
+		"salt":     func() (string, error) { return dictionaryCacheID(t.TempDir(), "password", spec) },
+	} {
+		got, err := other()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == id {
+			t.Errorf("Another %s gives the same ID", name)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, cacheSaltFile), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dictionaryCacheID(dir, "password", spec); err == nil {
+		t.Fatal("Used a corrupted salt")
+	}
+}
+
+func TestNewDictionaryGivesUpOnFruitlessSearches(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+
+	spec := DefaultDictionarySpec()
+	// The fake search has no results this deep.
+	spec.Offset = 900
+	_, err := NewDictionary(context.Background(), "password", client, DictionaryOptions{Width: 8, Spec: spec})
+	if err == nil || !strings.Contains(err.Error(), "stopped finding new tracks") {
+		t.Fatalf("NewDictionary returned %v, want an error", err)
+	}
+	if n := srv.Requests(); n > maxQueriesPerPage*(256/searchResults+1)+searchWorkers {
+		t.Fatalf("Ran %d searches", n)
+	}
+
+	d, err := NewDictionary(context.Background(), "password", client, DictionaryOptions{Width: 8, Spec: SequentialDictionarySpec()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.URIs) != 256 {
+		t.Fatalf("Got %d entries, want 256", len(d.URIs))
+	}
+}
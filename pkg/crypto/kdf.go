@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	KDFPBKDF2   = "pbkdf2-sha256"
+	KDFArgon2id = "argon2id"
+
+	// Argon2id costs recommended by RFC 9106 for memory constrained use.
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+
+	// Costs read from files and upload headers are refused above these, so
+	// that a crafted one cannot make key derivation exhaust memory or run
+	// for hours.
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 256 * 1024
+	maxArgon2Threads = 16
+	maxPBKDFIter     = 10 * pbkdfIterations
+)
+
+var ErrCorrupt = errors.New("Corrupted key derivation parameters")
+
+// KDFParams says how a key is derived from a password. Iterations is the
+// PBKDF2 iteration count or the Argon2id number of passes, Memory the Argon2id
+// memory cost in KiB.
+type KDFParams struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iter,omitempty"`
+	Memory     uint32 `json:"mem,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	Salt       []byte `json:"salt"`
+}
+
+// NewKDFParams returns the parameters used for anything encrypted from now
+// on, with a fresh salt.
+func NewKDFParams() (KDFParams, error) {
+	p := KDFParams{
+		KDF:        KDFArgon2id,
+		Iterations: argon2Time,
+		Memory:     argon2Memory,
+		Threads:    argon2Threads,
+		Salt:       make([]byte, saltSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, p.Salt); err != nil {
+		return KDFParams{}, err
+	}
+	return p, nil
+}
+
+// legacyKDFParams are the fixed parameters of headerless files written before
+// the KDF was recorded.
+func legacyKDFParams(salt []byte) KDFParams {
+	return KDFParams{KDF: KDFPBKDF2, Iterations: pbkdfIterations, Salt: salt}
+}
+
+// validate checks that the costs are usable and within the limits.
+func (p KDFParams) validate() error {
+	switch p.KDF {
+	case KDFPBKDF2:
+		if p.Iterations <= 0 || p.Iterations > maxPBKDFIter {
+			return fmt.Errorf("%w: PBKDF2 iteration count %d out of range", ErrCorrupt, p.Iterations)
+		}
+	case KDFArgon2id:
+		if p.Iterations <= 0 || p.Memory == 0 || p.Threads == 0 ||
+			p.Iterations > maxArgon2Time || p.Memory > maxArgon2Memory || p.Threads > maxArgon2Threads {
+			return fmt.Errorf("%w: Argon2id parameters t=%d m=%d p=%d out of range", ErrCorrupt, p.Iterations, p.Memory, p.Threads)
+		}
+	default:
+		return fmt.Errorf("Unsupported key derivation %q", p.KDF)
+	}
+	return nil
+}
+
+func (p KDFParams) Key(password string) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	if p.KDF == KDFPBKDF2 {
+		return pbkdf2.Key([]byte(password), p.Salt, p.Iterations, keySize, sha256.New), nil
+	}
+	return argon2.IDKey([]byte(password), p.Salt, uint32(p.Iterations), p.Memory, p.Threads, keySize), nil
+}
+
+func (p KDFParams) String() string {
+	switch p.KDF {
+	case KDFArgon2id:
+		return fmt.Sprintf("%s (t=%d, m=%d KiB, p=%d)", p.KDF, p.Iterations, p.Memory, p.Threads)
+	default:
+		return fmt.Sprintf("%s (%d iterations)", p.KDF, p.Iterations)
+	}
+}
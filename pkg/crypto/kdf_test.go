@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKDFLimits(t *testing.T) {
+	salt := make([]byte, saltSize)
+	tests := []struct {
+		name    string
+		params  KDFParams
+		corrupt bool
+	}{
+		{"argon2id default", KDFParams{KDF: KDFArgon2id, Iterations: argon2Time, Memory: argon2Memory, Threads: argon2Threads}, false},
+		{"argon2id memory", KDFParams{KDF: KDFArgon2id, Iterations: 1, Memory: maxArgon2Memory + 1, Threads: 1}, true},
+		{"argon2id passes", KDFParams{KDF: KDFArgon2id, Iterations: maxArgon2Time + 1, Memory: 8, Threads: 1}, true},
+		{"argon2id threads", KDFParams{KDF: KDFArgon2id, Iterations: 1, Memory: 8, Threads: maxArgon2Threads + 1}, true},
+		{"argon2id zero", KDFParams{KDF: KDFArgon2id}, true},
+		{"pbkdf2 legacy", legacyKDFParams(salt), false},
+		{"pbkdf2 iterations", KDFParams{KDF: KDFPBKDF2, Iterations: maxPBKDFIter + 1}, true},
+		{"pbkdf2 zero", KDFParams{KDF: KDFPBKDF2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Salt = salt
+			_, err := tt.params.Key("password")
+			if tt.corrupt != errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Key returned %v, corrupt %v expected", err, tt.corrupt)
+			}
+			if !tt.corrupt && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLoadEncryptedRefusesExcessiveCosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decoder.gob")
+	if err := SaveEncrypted(path, []byte("secret"), "password", 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Memory cost of 4 TiB, after magic, version, KDF id and passes.
+	copy(data[len(EncryptedMagic)+6:], []byte{0xff, 0xff, 0xff, 0xff})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadEncrypted(path, "password"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("LoadEncrypted returned %v, want ErrCorrupt", err)
+	}
+	if _, err := EncryptedFileKDF(path); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("EncryptedFileKDF returned %v, want ErrCorrupt", err)
+	}
+}
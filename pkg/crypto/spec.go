@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"fmt"
+	"strings"
+
+	spotify "spotifyfs/pkg/spotify"
+)
+
+// Search fields a DictionarySpec can restrict its queries to. SearchAny
+// matches the query against any field.
+const (
+	SearchAny    = ""
+	SearchTrack  = "track"
+	SearchArtist = "artist"
+	SearchAlbum  = "album"
+)
+
+const (
+	// maxSearchOffset is how deep into the results Spotify lets a search
+	// page.
+	maxSearchOffset = 1000
+	// maxQueryLength keeps queries, which are built one byte per
+	// character, within what the search endpoint accepts.
+	maxQueryLength = 100
+	// maxHomophones keeps 16-bit dictionaries within a million tracks.
+	maxHomophones = 16
+)
+
+// DictionarySpec is everything besides the password that decides which tracks
+// a dictionary holds: the market searches run in, how queries are built and
+// which of their results are taken. It is stored with every upload so that
+// the reader searches exactly the way the writer did.
+type DictionarySpec struct {
+	Market string `json:"market"`
+	// QueryLength characters are drawn from Charset to build each query.
+	QueryLength int    `json:"query_length"`
+	Charset     string `json:"charset"`
+	// SearchType restricts queries to one field, e.g. "track:abcde".
+	SearchType string `json:"search_type,omitempty"`
+	// Results are taken from each search, starting with result Offset.
+	Offset  int `json:"offset,omitempty"`
+	Results int `json:"results"`
+	// Homophones is how many tracks stand for each symbol; 0 means one.
+	Homophones int `json:"homophones,omitempty"`
+}
+
+// SequentialDictionarySpec is how every dictionary was searched before the
+// spec existed: the first result of searches in the US.
+func SequentialDictionarySpec() DictionarySpec {
+	return DictionarySpec{
+		Market:      spotify.DefaultMarket,
+		QueryLength: LengthRNGString,
+		Charset:     Charset,
+		Results:     1,
+	}
+}
+
+// DefaultDictionarySpec takes every result of each search, which needs far
+// fewer of them.
+func DefaultDictionarySpec() DictionarySpec {
+	spec := SequentialDictionarySpec()
+	spec.Results = searchResults
+	return spec
+}
+
+// Dictionary versions, the presets uploads recorded before full specs were.
+const (
+	DictionarySequential = 1
+	DictionaryBatched    = 2
+)
+
+// DictionarySpecVersion returns the spec of a dictionary version; 0 stands
+// for files written before versions existed.
+func DictionarySpecVersion(version int) (DictionarySpec, error) {
+	switch version {
+	case 0, DictionarySequential:
+		return SequentialDictionarySpec(), nil
+	case DictionaryBatched:
+		return DefaultDictionarySpec(), nil
+	}
+	return DictionarySpec{}, fmt.Errorf("Unsupported dictionary version %d", version)
+}
+
+func (spec DictionarySpec) Validate() error {
+	if len(spec.Market) != 2 || strings.ToUpper(spec.Market) != spec.Market {
+		return fmt.Errorf("Invalid market %q, expected an ISO 3166-1 alpha-2 code such as US", spec.Market)
+	}
+	if spec.QueryLength < 1 || spec.QueryLength > maxQueryLength {
+		return fmt.Errorf("Invalid query length %d, expected 1 to %d", spec.QueryLength, maxQueryLength)
+	}
+	// Quotes and colons have a meaning in search queries.
+	if len(spec.Charset) < 2 || strings.ContainsAny(spec.Charset, ":\"") {
+		return fmt.Errorf("Invalid charset %q: it needs at least two characters and no colon or quote", spec.Charset)
+	}
+	for i := 0; i < len(spec.Charset); i++ {
+		if spec.Charset[i] < 0x20 || spec.Charset[i] > 0x7e {
+			return fmt.Errorf("Invalid charset %q: only printable ASCII characters are supported", spec.Charset)
+		}
+	}
+	switch spec.SearchType {
+	case SearchAny, SearchTrack, SearchArtist, SearchAlbum:
+	default:
+		return fmt.Errorf("Invalid search type %q, expected %s, %s or %s", spec.SearchType, SearchTrack, SearchArtist, SearchAlbum)
+	}
+	if spec.Results < 1 || spec.Results > searchResults {
+		return fmt.Errorf("Invalid results per search %d, expected 1 to %d", spec.Results, searchResults)
+	}
+	if spec.Offset < 0 || spec.Offset+spec.Results > maxSearchOffset {
+		return fmt.Errorf("Invalid result offset %d, results must stay within the first %d", spec.Offset, maxSearchOffset)
+	}
+	if spec.Homophones < 0 || spec.Homophones > maxHomophones {
+		return fmt.Errorf("Invalid homophones %d, expected 1 to %d tracks per symbol", spec.Homophones, maxHomophones)
+	}
+	return nil
+}
+
+func (spec DictionarySpec) homophones() int {
+	return max(1, spec.Homophones)
+}
+
+// query builds the search query number n of a password's seed.
+func (spec DictionarySpec) query(seed []byte, n uint64) string {
+	q := NewRNGStringWithSeed(spec.QueryLength, spec.Charset, seed, n)
+	if spec.SearchType != SearchAny {
+		q = spec.SearchType + ":" + q
+	}
+	return q
+}
+
+func (spec DictionarySpec) String() string {
+	s := fmt.Sprintf("market %s, %d-character queries over %d characters, results %d to %d",
+		spec.Market, spec.QueryLength, len(spec.Charset), spec.Offset+1, spec.Offset+spec.Results)
+	if spec.SearchType != SearchAny {
+		s += ", " + spec.SearchType + " field only"
+	}
+	if spec.homophones() > 1 {
+		s += fmt.Sprintf(", %d tracks per symbol", spec.homophones())
+	}
+	return s
+}
@@ -0,0 +1,214 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	StreamCipher     = "aes-256-gcm"
+	DefaultChunkSize = 64 * 1024
+
+	// The 12 byte GCM nonce is noncePrefixSize random bytes, a big endian
+	// uint32 chunk counter and a byte set to 1 on the last chunk only, so
+	// chunks can be neither reordered nor dropped from the end.
+	noncePrefixSize = 7
+	maxChunkSize    = 1 << 20
+)
+
+var ErrAuthentication = errors.New("Payload failed authentication: the playlists were altered or the password is wrong")
+
+// StreamParams describes how an upload's payload was encrypted. It is stored
+// in the clear in the upload header; the key itself is derived from the
+// password.
+type StreamParams struct {
+	Cipher string `json:"cipher"`
+	KDFParams
+	Nonce     []byte `json:"nonce"`
+	ChunkSize int    `json:"chunk"`
+}
+
+// NewStreamParams picks a fresh salt and nonce prefix for a new upload.
+func NewStreamParams() (StreamParams, error) {
+	kdf, err := NewKDFParams()
+	if err != nil {
+		return StreamParams{}, err
+	}
+	p := StreamParams{
+		Cipher:    StreamCipher,
+		KDFParams: kdf,
+		Nonce:     make([]byte, noncePrefixSize),
+		ChunkSize: DefaultChunkSize,
+	}
+	if _, err := io.ReadFull(rand.Reader, p.Nonce); err != nil {
+		return StreamParams{}, err
+	}
+	return p, nil
+}
+
+// KeyCheck returns a value that identifies key without revealing it, so that
+// a resumed upload can make sure it was given the same password.
+func KeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("spotifyfs key check"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (p StreamParams) aead(key []byte) (cipher.AEAD, error) {
+	if p.Cipher != StreamCipher {
+		return nil, fmt.Errorf("Unsupported cipher %q", p.Cipher)
+	}
+	if p.ChunkSize <= 0 || p.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("Invalid chunk size %d", p.ChunkSize)
+	}
+	if len(p.Nonce) != noncePrefixSize {
+		return nil, fmt.Errorf("Invalid nonce prefix length %d", len(p.Nonce))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (p StreamParams) nonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, p.Nonce...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptReader seals what it reads from r chunk by chunk. The output only
+// depends on the plaintext, key and params, so an interrupted upload can
+// produce the exact same bytes again.
+type encryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	params  StreamParams
+	aad     []byte
+	counter uint32
+	// plain holds one chunk plus one byte read ahead to tell whether the
+	// chunk is the last one.
+	plain  []byte
+	have   int
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+// NewEncryptReader returns a reader of the ciphertext of r. aad is
+// authenticated with every chunk, typically the header written in front.
+func NewEncryptReader(r io.Reader, key []byte, params StreamParams, aad []byte) (io.Reader, error) {
+	aead, err := params.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		r:      r,
+		aead:   aead,
+		params: params,
+		aad:    aad,
+		plain:  make([]byte, params.ChunkSize+1),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) fill() error {
+	n, err := io.ReadFull(e.r, e.plain[e.have:])
+	total := e.have + n
+	switch {
+	case err == nil:
+		chunk := e.params.ChunkSize
+		e.sealed = e.aead.Seal(e.sealed[:0], e.params.nonce(e.counter, false), e.plain[:chunk], e.aad)
+		e.plain[0] = e.plain[chunk]
+		e.have = 1
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		e.sealed = e.aead.Seal(e.sealed[:0], e.params.nonce(e.counter, true), e.plain[:total], e.aad)
+		e.done = true
+	default:
+		return err
+	}
+
+	e.out = e.sealed
+	e.counter++
+	if e.counter == 0 {
+		return errors.New("Too many chunks for one stream")
+	}
+	return nil
+}
+
+type decryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	params  StreamParams
+	aad     []byte
+	counter uint32
+	buf     []byte
+}
+
+// NewDecryptWriter returns a writer that authenticates and decrypts the
+// ciphertext written to it into w. Close must be called to check the last
+// chunk; a stream cut short fails there with ErrAuthentication.
+func NewDecryptWriter(w io.Writer, key []byte, params StreamParams, aad []byte) (io.WriteCloser, error) {
+	aead, err := params.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptWriter{w: w, aead: aead, params: params, aad: aad}, nil
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	sealed := d.params.ChunkSize + d.aead.Overhead()
+
+	// A full chunk can only be opened once something follows it, since
+	// otherwise it may be the last one.
+	offset := 0
+	for len(d.buf)-offset > sealed {
+		if err := d.open(d.buf[offset:offset+sealed], false); err != nil {
+			return 0, err
+		}
+		offset += sealed
+	}
+	d.buf = append(d.buf[:0], d.buf[offset:]...)
+	return len(p), nil
+}
+
+func (d *decryptWriter) open(chunk []byte, last bool) error {
+	plain, err := d.aead.Open(nil, d.params.nonce(d.counter, last), chunk, d.aad)
+	if err != nil {
+		return fmt.Errorf("%w (chunk %d)", ErrAuthentication, d.counter)
+	}
+	d.counter++
+	_, err = d.w.Write(plain)
+	return err
+}
+
+func (d *decryptWriter) Close() error {
+	return d.open(d.buf, true)
+}
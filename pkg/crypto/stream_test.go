@@ -0,0 +1,149 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+const testChunkSize = 64
+
+func testStream(t *testing.T) ([]byte, StreamParams) {
+	t.Helper()
+	params, err := NewStreamParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.ChunkSize = testChunkSize
+	key := make([]byte, keySize)
+	rand.NewChaCha8([32]byte{1}).Read(key)
+	return key, params
+}
+
+func testPlaintext(n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{2}).Read(data)
+	return data
+}
+
+func encryptStream(t *testing.T, key []byte, params StreamParams, plaintext, aad []byte) []byte {
+	t.Helper()
+	r, err := NewEncryptReader(bytes.NewReader(plaintext), key, params, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// decryptStream writes sealed in uneven pieces, so that chunks straddle
+// writes.
+func decryptStream(key []byte, params StreamParams, sealed, aad []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := NewDecryptWriter(&out, key, params, aad)
+	if err != nil {
+		return nil, err
+	}
+	for len(sealed) > 0 {
+		n := min(len(sealed), 37)
+		if _, err := w.Write(sealed[:n]); err != nil {
+			return nil, err
+		}
+		sealed = sealed[n:]
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, params := testStream(t)
+	aad := []byte("header")
+	for _, n := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3 * testChunkSize, 3*testChunkSize + 5} {
+		plaintext := testPlaintext(n)
+		sealed := encryptStream(t, key, params, plaintext, aad)
+		got, err := decryptStream(key, params, sealed, aad)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("%d bytes: decrypted data differs", n)
+		}
+	}
+}
+
+func TestStreamIsDeterministic(t *testing.T) {
+	key, params := testStream(t)
+	plaintext := testPlaintext(5 * testChunkSize)
+	if !bytes.Equal(encryptStream(t, key, params, plaintext, nil), encryptStream(t, key, params, plaintext, nil)) {
+		t.Fatal("Encrypting twice gave different ciphertexts")
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	key, params := testStream(t)
+	aad := []byte("header")
+	plaintext := testPlaintext(4*testChunkSize + 10)
+	sealed := encryptStream(t, key, params, plaintext, aad)
+	chunk := testChunkSize + 16
+
+	swapped := bytes.Clone(sealed)
+	copy(swapped[chunk:2*chunk], sealed[2*chunk:3*chunk])
+	copy(swapped[2*chunk:3*chunk], sealed[chunk:2*chunk])
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)/2] ^= 1
+
+	otherKey := bytes.Clone(key)
+	otherKey[0] ^= 1
+
+	tests := []struct {
+		name   string
+		key    []byte
+		sealed []byte
+		aad    []byte
+	}{
+		{"truncated at a chunk boundary", key, sealed[:2*chunk], aad},
+		{"truncated inside a chunk", key, sealed[:2*chunk+20], aad},
+		{"last chunk dropped", key, sealed[:4*chunk], aad},
+		{"empty", key, nil, aad},
+		{"chunks reordered", key, swapped, aad},
+		{"chunk repeated", key, append(bytes.Clone(sealed[:2*chunk]), sealed[chunk:]...), aad},
+		{"bit flipped", key, flipped, aad},
+		{"wrong key", otherKey, sealed, aad},
+		{"wrong header", key, sealed, []byte("other header")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decryptStream(tt.key, params, tt.sealed, tt.aad); !errors.Is(err, ErrAuthentication) {
+				t.Fatalf("Got %v, want ErrAuthentication", err)
+			}
+		})
+	}
+}
+
+func TestStreamWrongPassword(t *testing.T) {
+	_, params := testStream(t)
+	key, err := params.Key("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := params.Key("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyCheck(key) == KeyCheck(wrong) {
+		t.Fatal("KeyCheck does not tell the keys apart")
+	}
+
+	sealed := encryptStream(t, key, params, testPlaintext(2*testChunkSize), nil)
+	if _, err := decryptStream(wrong, params, sealed, nil); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("Got %v, want ErrAuthentication", err)
+	}
+}
@@ -0,0 +1,47 @@
+package crypto
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+// cachedToken is the layout of the token cache. Caches written before the
+// scopes were recorded have none.
+type cachedToken struct {
+	*oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// SaveToken stores an OAuth token and the scopes it was granted encrypted
+// under secret, readable only by the current user.
+func SaveToken(path string, token *oauth2.Token, scopes []string, secret string) error {
+	data, err := json.Marshal(cachedToken{Token: token, Scopes: scopes})
+	if err != nil {
+		return fmt.Errorf("Error marshaling token: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Error creating token cache directory: %w", err)
+	}
+
+	return SaveEncrypted(path, data, secret, 0600)
+}
+
+// LoadToken returns the token saved by SaveToken and its scopes.
+func LoadToken(path, secret string) (*oauth2.Token, []string, error) {
+	data, err := LoadEncrypted(path, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cached := cachedToken{Token: new(oauth2.Token)}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, nil, fmt.Errorf("Error reading cached token: %w", err)
+	}
+
+	return cached.Token, cached.Scopes, nil
+}
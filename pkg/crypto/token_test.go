@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.bin")
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer", Expiry: time.Unix(1700000000, 0)}
+	scopes := []string{"playlist-read-private", "ugc-image-upload"}
+	if err := SaveToken(path, token, scopes, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	checkToken := func(wantScopes []string) {
+		t.Helper()
+		got, gotScopes, err := LoadToken(path, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.AccessToken != token.AccessToken || got.RefreshToken != token.RefreshToken || !got.Expiry.Equal(token.Expiry) {
+			t.Fatalf("Loaded %+v, want %+v", got, token)
+		}
+		if !slices.Equal(gotScopes, wantScopes) {
+			t.Fatalf("Loaded scopes %v, want %v", gotScopes, wantScopes)
+		}
+	}
+	checkToken(scopes)
+
+	// Caches from before scopes were recorded hold the bare token.
+	data, err := json.Marshal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveEncrypted(path, data, "secret", 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkToken(nil)
+}
+
+func TestTokenCacheIsReplacedWhole(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token.bin")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token := &oauth2.Token{AccessToken: fmt.Sprintf("access %d", i)}
+			if err := SaveToken(path, token, nil, "secret"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, _, err := LoadToken(path, "secret"); err != nil {
+		t.Fatalf("Concurrent saves left an unreadable cache: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Found %d files, want the cache alone", len(entries))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("Cache has mode %v, want 0600", perm)
+	}
+}
@@ -0,0 +1,185 @@
+// Package fec implements a systematic Reed-Solomon erasure code over GF(256).
+//
+// A Code turns k data shards into k+m shards such that any k of them are
+// enough to rebuild the data. The parity rows form a Cauchy matrix, so every
+// k×k submatrix of the generator is invertible.
+package fec
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTooManyErasures = errors.New("Too many shards lost to reconstruct the data")
+
+// GF(256) with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+type Code struct {
+	DataShards   int
+	ParityShards int
+	// parity[i][j] is the coefficient of data shard j in parity shard i.
+	parity [][]byte
+}
+
+func NewCode(dataShards, parityShards int) (*Code, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("Invalid shard counts %d+%d", dataShards, parityShards)
+	}
+
+	c := &Code{DataShards: dataShards, ParityShards: parityShards}
+	for i := 0; i < parityShards; i++ {
+		row := make([]byte, dataShards)
+		for j := range row {
+			// x_i = k+i and y_j = j are distinct, so x_i+y_j is never 0.
+			row[j] = inv(byte(dataShards+i) ^ byte(j))
+		}
+		c.parity = append(c.parity, row)
+	}
+	return c, nil
+}
+
+// row returns the generator row of shard i.
+func (c *Code) row(i int) []byte {
+	if i >= c.DataShards {
+		return c.parity[i-c.DataShards]
+	}
+	row := make([]byte, c.DataShards)
+	row[i] = 1
+	return row
+}
+
+// Encode fills the parity shards, shards[k:], from the data shards. All
+// shards must have the same length.
+func (c *Code) Encode(shards [][]byte) error {
+	if len(shards) != c.DataShards+c.ParityShards {
+		return fmt.Errorf("Expected %d shards, got %d", c.DataShards+c.ParityShards, len(shards))
+	}
+	for i, coefficients := range c.parity {
+		out := shards[c.DataShards+i]
+		clear(out)
+		for j, coefficient := range coefficients {
+			mulAdd(out, shards[j], coefficient)
+		}
+	}
+	return nil
+}
+
+// Reconstruct rebuilds the data shards that are not present from any k
+// shards that are. Parity shards are left as they are.
+func (c *Code) Reconstruct(shards [][]byte, present []bool) error {
+	var rows []int
+	missing := false
+	for i := range shards {
+		if present[i] {
+			if len(rows) < c.DataShards {
+				rows = append(rows, i)
+			}
+		} else if i < c.DataShards {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	if len(rows) < c.DataShards {
+		return ErrTooManyErasures
+	}
+
+	matrix := make([][]byte, c.DataShards)
+	for r, shard := range rows {
+		matrix[r] = append([]byte(nil), c.row(shard)...)
+	}
+	decode, err := invert(matrix)
+	if err != nil {
+		return err
+	}
+
+	size := len(shards[rows[0]])
+	for j := 0; j < c.DataShards; j++ {
+		if present[j] {
+			continue
+		}
+		out := make([]byte, size)
+		for r, shard := range rows {
+			mulAdd(out, shards[shard], decode[j][r])
+		}
+		shards[j] = out
+	}
+	return nil
+}
+
+func mulAdd(out, in []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	for i, b := range in {
+		out[i] ^= mul(coefficient, b)
+	}
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination.
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	result := make([][]byte, n)
+	for i := range result {
+		result[i] = make([]byte, n)
+		result[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && matrix[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("Singular matrix")
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		result[col], result[pivot] = result[pivot], result[col]
+
+		scale := inv(matrix[col][col])
+		for j := 0; j < n; j++ {
+			matrix[col][j] = mul(matrix[col][j], scale)
+			result[col][j] = mul(result[col][j], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || matrix[row][col] == 0 {
+				continue
+			}
+			factor := matrix[row][col]
+			for j := 0; j < n; j++ {
+				matrix[row][j] ^= mul(factor, matrix[col][j])
+				result[row][j] ^= mul(factor, result[col][j])
+			}
+		}
+	}
+	return result, nil
+}
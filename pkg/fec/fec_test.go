@@ -0,0 +1,136 @@
+package fec
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func testShards(t *testing.T, c *Code, size int) [][]byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(int64(c.DataShards*256 + c.ParityShards)))
+	shards := make([][]byte, c.DataShards+c.ParityShards)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < c.DataShards {
+			rng.Read(shards[i])
+		}
+	}
+	if err := c.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+// erase returns a copy of shards without those whose bit is set in pattern.
+func erase(shards [][]byte, pattern uint) ([][]byte, []bool) {
+	damaged := make([][]byte, len(shards))
+	present := make([]bool, len(shards))
+	for i, shard := range shards {
+		if pattern&(1<<i) == 0 {
+			damaged[i] = bytes.Clone(shard)
+			present[i] = true
+		}
+	}
+	return damaged, present
+}
+
+func TestReconstructEveryErasurePattern(t *testing.T) {
+	tests := []struct{ k, m int }{
+		{1, 1}, {1, 3}, {2, 1}, {3, 2}, {4, 4}, {5, 3}, {8, 4},
+	}
+	for _, tt := range tests {
+		c, err := NewCode(tt.k, tt.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := testShards(t, c, 7)
+		n := tt.k + tt.m
+		for pattern := uint(0); pattern < 1<<n; pattern++ {
+			erased := bits.OnesCount(pattern)
+			if erased > tt.m+1 {
+				continue
+			}
+			damaged, present := erase(shards, pattern)
+			err := c.Reconstruct(damaged, present)
+			if erased > tt.m {
+				if !errors.Is(err, ErrTooManyErasures) {
+					t.Fatalf("%d+%d, erased %b: got %v, want ErrTooManyErasures", tt.k, tt.m, pattern, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%d+%d, erased %b: %v", tt.k, tt.m, pattern, err)
+			}
+			for i := range tt.k {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("%d+%d, erased %b: data shard %d differs", tt.k, tt.m, pattern, i)
+				}
+			}
+		}
+	}
+}
+
+func TestReconstructLargeCodes(t *testing.T) {
+	tests := []struct{ k, m int }{
+		{32, 8}, {200, 56}, {255, 1},
+	}
+	for _, tt := range tests {
+		c, err := NewCode(tt.k, tt.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := testShards(t, c, 3)
+		n := tt.k + tt.m
+		rng := rand.New(rand.NewSource(int64(n)))
+		for range 20 {
+			order := rng.Perm(n)
+			for _, erased := range []int{tt.m, tt.m + 1} {
+				damaged := make([][]byte, n)
+				present := make([]bool, n)
+				for _, i := range order[erased:] {
+					damaged[i] = bytes.Clone(shards[i])
+					present[i] = true
+				}
+				err := c.Reconstruct(damaged, present)
+				if erased > tt.m {
+					if !errors.Is(err, ErrTooManyErasures) {
+						t.Fatalf("%d+%d, %d erased: got %v, want ErrTooManyErasures", tt.k, tt.m, erased, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%d+%d, %d erased: %v", tt.k, tt.m, erased, err)
+				}
+				for i := range tt.k {
+					if !bytes.Equal(damaged[i], shards[i]) {
+						t.Fatalf("%d+%d, %d erased: data shard %d differs", tt.k, tt.m, erased, i)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNewCodeRejectsInvalidCounts(t *testing.T) {
+	for _, tt := range []struct{ k, m int }{{0, 1}, {-1, 2}, {1, -1}, {200, 57}} {
+		if _, err := NewCode(tt.k, tt.m); err == nil {
+			t.Errorf("NewCode(%d, %d) succeeded", tt.k, tt.m)
+		}
+	}
+	if _, err := NewCode(4, 0); err != nil {
+		t.Errorf("NewCode(4, 0): %v", err)
+	}
+}
+
+func TestEncodeRejectsWrongShardCount(t *testing.T) {
+	c, err := NewCode(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Encode(make([][]byte, 4)); err == nil {
+		t.Fatal("Encode accepted 4 shards for a 3+2 code")
+	}
+}
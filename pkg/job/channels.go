@@ -0,0 +1,187 @@
+package job
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"spotifyfs/pkg/spotify"
+	"strings"
+)
+
+// Channels selects the playlist metadata that carries payload besides the
+// tracks. Every data playlist then holds, in stream order, up to
+// descriptionCapacity bytes in its description, up to coverCapacity bytes in
+// its cover and the rest in its tracks, so that small files need fewer
+// playlists and tracks. Index playlists only use their tracks.
+type Channels uint8
+
+const (
+	ChannelDescription Channels = 1 << iota
+	ChannelCover
+
+	channelNames = "description, cover"
+)
+
+// descriptionCapacity is how many bytes fit, base64 encoded, in a data
+// playlist description after the ID of the next playlist and a separator.
+var descriptionCapacity = base64.RawURLEncoding.DecodedLen(maxDescriptionLength - playlistIDLength - 1)
+
+// ParseChannels parses a comma separated list of channel names, "all" or
+// "none".
+func ParseChannels(list string) (Channels, error) {
+	var c Channels
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "none":
+		case "description":
+			c |= ChannelDescription
+		case "cover":
+			c |= ChannelCover
+		case "all":
+			c |= ChannelDescription | ChannelCover
+		default:
+			return 0, fmt.Errorf("Unknown channel %q, expected %s, all or none", name, channelNames)
+		}
+	}
+	return c, nil
+}
+
+func (c Channels) String() string {
+	var names []string
+	if c&ChannelDescription != 0 {
+		names = append(names, "description")
+	}
+	if c&ChannelCover != 0 {
+		names = append(names, "cover")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// field is how the index description records c: one letter per channel.
+func (c Channels) field() string {
+	var field string
+	if c&ChannelDescription != 0 {
+		field += "d"
+	}
+	if c&ChannelCover != 0 {
+		field += "c"
+	}
+	return field
+}
+
+// parseChannelsField never fails, unknown letters give a value that fails
+// validation so that the upload is not read without them.
+func parseChannelsField(field string) Channels {
+	var c Channels
+	for _, letter := range field {
+		switch letter {
+		case 'd':
+			c |= ChannelDescription
+		case 'c':
+			c |= ChannelCover
+		default:
+			c |= 1 << 7
+		}
+	}
+	return c
+}
+
+func (c Channels) validate() error {
+	if c&^(ChannelDescription|ChannelCover) != 0 {
+		return fmt.Errorf("Unsupported metadata channels %q", c.field())
+	}
+	return nil
+}
+
+// capacity is how many bytes the channels add to a playlist.
+func (c Channels) capacity() int {
+	n := 0
+	if c&ChannelDescription != 0 {
+		n += descriptionCapacity
+	}
+	if c&ChannelCover != 0 {
+		n += coverCapacity
+	}
+	return n
+}
+
+// split cuts the payload of a playlist into the parts its description, cover
+// and tracks carry.
+func (c Channels) split(block []byte) (description, cover, tracks []byte) {
+	if c&ChannelDescription != 0 {
+		n := min(len(block), descriptionCapacity)
+		description, block = block[:n], block[n:]
+	}
+	if c&ChannelCover != 0 {
+		n := min(len(block), coverCapacity)
+		cover, block = block[:n], block[n:]
+	}
+	return description, cover, block
+}
+
+// dataDescription is the description of a data playlist: the ID of the next
+// one, followed with the description channel by ";" and the payload.
+func dataDescription(next string, payload []byte) string {
+	if payload == nil {
+		return next
+	}
+	return next + ";" + base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// parseDataDescription splits a data playlist description into the ID of the
+// next playlist and the payload of the description channel.
+func parseDataDescription(description string) (string, []byte, error) {
+	next, encoded, _ := strings.Cut(strings.TrimSpace(description), ";")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return next, nil, fmt.Errorf("Invalid description payload: %w", err)
+	}
+	return next, payload, nil
+}
+
+// readChannels returns the payload the channels of a data playlist carry
+// before the trackBytes bytes of its tracks. A channel is only used once the
+// ones before it are full, which tells truncated ones apart.
+func readChannels(ctx context.Context, s *spotify.SpotifyClient, playlistID string, channels Channels, trackBytes int) ([]byte, error) {
+	var payload []byte
+	if channels&ChannelDescription != 0 {
+		details, err := s.GetPlaylistDetails(ctx, playlistID)
+		if err != nil {
+			return nil, &ErrPlaylistFetch{PlaylistID: playlistID, Err: err}
+		}
+		if _, payload, err = parseDataDescription(details.Description); err != nil {
+			return nil, fmt.Errorf("Playlist %s: %w", playlistID, err)
+		}
+		if len(payload) < descriptionCapacity {
+			if trackBytes > 0 {
+				return nil, fmt.Errorf("%w: the description of playlist %s holds %d bytes, expected %d", ErrIndexMismatch, playlistID, len(payload), descriptionCapacity)
+			}
+			// The stream ended in the description.
+			return payload, nil
+		}
+	}
+
+	if channels&ChannelCover != 0 {
+		image, err := s.GetPlaylistCover(ctx, playlistID)
+		if errors.Is(err, spotify.ErrNoCover) && trackBytes == 0 {
+			// The stream ended right after the description.
+			return payload, nil
+		}
+		if err != nil {
+			return nil, &ErrPlaylistFetch{PlaylistID: playlistID, Err: err}
+		}
+		cover, err := decodeCover(image)
+		if err != nil {
+			return nil, fmt.Errorf("Playlist %s: %w", playlistID, err)
+		}
+		if len(cover) < coverCapacity && trackBytes > 0 {
+			return nil, fmt.Errorf("%w: the cover of playlist %s holds %d bytes, expected %d", ErrIndexMismatch, playlistID, len(cover), coverCapacity)
+		}
+		payload = append(payload, cover...)
+	}
+	return payload, nil
+}
@@ -0,0 +1,115 @@
+package job
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	CompressionAuto = "auto"
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+
+	// Auto compression looks at this much of the file and keeps gzip only
+	// when it saves at least a tenth of it.
+	compressionSample   = 256 * 1024
+	compressionMaxRatio = 0.9
+)
+
+// chooseCompression resolves the requested mode into gzip or none, looking
+// ahead in input without consuming it.
+func chooseCompression(input *bufio.Reader, mode string) (string, error) {
+	switch mode {
+	case CompressionGzip, CompressionNone:
+		return mode, nil
+	case "", CompressionAuto:
+	default:
+		return "", fmt.Errorf("Unknown compression %q, expected %s, %s or %s", mode, CompressionAuto, CompressionGzip, CompressionNone)
+	}
+
+	sample, err := input.Peek(compressionSample)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Error reading file: %w", err)
+	}
+	n := len(sample)
+	if n == 0 {
+		return CompressionNone, nil
+	}
+
+	var compressed bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	gz.Write(sample[:n])
+	gz.Close()
+
+	if float64(compressed.Len()) > float64(n)*compressionMaxRatio {
+		fmt.Printf("File does not compress (%d -> %d bytes sampled), storing it as is\n", n, compressed.Len())
+		return CompressionNone, nil
+	}
+	fmt.Printf("Compressing with gzip (%d -> %d bytes sampled)\n", n, compressed.Len())
+	return CompressionGzip, nil
+}
+
+// compressReader returns the gzip stream of r. Its output only depends on r,
+// so a resumed upload compresses to the same bytes. Close stops the
+// compression when the reader is abandoned early.
+func compressReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz, _ := gzip.NewWriterLevel(pw, gzip.BestCompression)
+		_, err := io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decompressWriter inflates what is written to it into w.
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecompressWriter(w io.Writer) *decompressWriter {
+	pr, pw := io.Pipe()
+	d := &decompressWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := inflate(w, pr)
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d
+}
+
+func inflate(w io.Writer, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Error decompressing: %w", err)
+	}
+	gz.Multistream(false)
+	if _, err := io.Copy(w, gz); err != nil {
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("Error decompressing: %w", err)
+		}
+		return err
+	}
+	// Anything after the gzip stream means the upload is not what it says.
+	if n, _ := io.Copy(io.Discard, r); n > 0 {
+		return fmt.Errorf("Error decompressing: %d unexpected bytes after the compressed data", n)
+	}
+	return nil
+}
+
+func (d *decompressWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *decompressWriter) Close() error {
+	d.pw.Close()
+	return <-d.done
+}
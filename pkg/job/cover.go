@@ -0,0 +1,105 @@
+package job
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// Covers hold data as a grid of flat gray cells, each of them aligned on the
+// 8x8 blocks of the JPEG encoding and carrying two bits as one of four gray
+// levels. Spotify re-encodes and may resize the covers it serves, which
+// blurs edges but keeps the average of every cell close to its level. The
+// payload is stored with its length and a CRC-32.
+const (
+	coverGrid      = 80
+	coverCell      = 8
+	coverSize      = coverGrid * coverCell
+	coverBits      = 2
+	coverQuality   = 90
+	coverFrameSize = coverGrid * coverGrid * coverBits / 8
+
+	coverCapacity = coverFrameSize - blockLengthSize - crcSize
+)
+
+var coverLevels = [1 << coverBits]uint8{0, 85, 170, 255}
+
+// encodeCover returns a JPEG cover holding payload, at most coverCapacity
+// bytes.
+func encodeCover(payload []byte) ([]byte, error) {
+	if len(payload) > coverCapacity {
+		return nil, fmt.Errorf("Cover payload of %d bytes exceeds %d", len(payload), coverCapacity)
+	}
+	frame := make([]byte, coverFrameSize)
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[blockLengthSize:], payload)
+	binary.BigEndian.PutUint32(frame[blockLengthSize+len(payload):], crc32.ChecksumIEEE(frame[:blockLengthSize+len(payload)]))
+
+	img := image.NewGray(image.Rect(0, 0, coverSize, coverSize))
+	for cell := 0; cell < coverGrid*coverGrid; cell++ {
+		bit := cell * coverBits
+		value := frame[bit/8] >> (8 - coverBits - bit%8) & (1<<coverBits - 1)
+		x0, y0 := cell%coverGrid*coverCell, cell/coverGrid*coverCell
+		for y := y0; y < y0+coverCell; y++ {
+			for x := x0; x < x0+coverCell; x++ {
+				img.SetGray(x, y, color.Gray{Y: coverLevels[value]})
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: coverQuality}); err != nil {
+		return nil, fmt.Errorf("Error encoding cover: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// decodeCover reads the payload back from a cover, at whatever size it is
+// served, by averaging the middle of every cell.
+func decodeCover(data []byte) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding cover: %w", err)
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < coverGrid*2 || height < coverGrid*2 {
+		return nil, fmt.Errorf("Cover is %dx%d, too small to hold data", width, height)
+	}
+
+	frame := make([]byte, coverFrameSize)
+	for cell := 0; cell < coverGrid*coverGrid; cell++ {
+		col, row := cell%coverGrid, cell/coverGrid
+		x0, x1 := col*width/coverGrid, (col+1)*width/coverGrid
+		y0, y1 := row*height/coverGrid, (row+1)*height/coverGrid
+		// Edges are left out, they bleed into the neighbouring cells.
+		x0, x1 = x0+(x1-x0)/4, x1-(x1-x0)/4
+		y0, y1 = y0+(y1-y0)/4, y1-(y1-y0)/4
+
+		sum, n := 0, 0
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				sum += int(color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y)
+				n++
+			}
+		}
+		value := byte((sum/n*(len(coverLevels)-1) + 127) / 255)
+		bit := cell * coverBits
+		frame[bit/8] |= value << (8 - coverBits - bit%8)
+	}
+
+	length := int(binary.BigEndian.Uint16(frame))
+	if length > coverCapacity {
+		return nil, errors.New("Cover payload length is out of range")
+	}
+	end := blockLengthSize + length
+	if binary.BigEndian.Uint32(frame[end:]) != crc32.ChecksumIEEE(frame[:end]) {
+		return nil, errors.New("Cover payload checksum mismatch")
+	}
+	return frame[blockLengthSize:end], nil
+}
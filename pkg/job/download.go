@@ -0,0 +1,315 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"spotifyfs/pkg/crypto"
+	"sync"
+)
+
+const progressFile = "progress.json"
+
+// downloadProgress keeps the playlists read so far in a directory, one file
+// per playlist, so that an interrupted Reader only fetches what is missing.
+// Without a directory it only tracks the chain, and the playlists are handed
+// on as they are read.
+type downloadProgress struct {
+	mu  sync.Mutex
+	dir string
+
+	Start         string   `json:"start"`
+	Playlists     []string `json:"playlists"`
+	Completed     []bool   `json:"completed"`
+	ChainComplete bool     `json:"chain_complete"`
+	// Indexed is set when the playlists came from an index rather than
+	// from walking the chain, and Tracks then holds the length of each.
+	Indexed bool  `json:"indexed,omitempty"`
+	Tracks  []int `json:"tracks,omitempty"`
+	// FEC is the erasure code given by the index.
+	FEC *FECParams `json:"fec,omitempty"`
+	// Width is the symbol width given by the index, and Bytes the payload
+	// length of every playlist when it is wider than 8 bits.
+	Width int   `json:"width,omitempty"`
+	Bytes []int `json:"bytes,omitempty"`
+	// Dictionary is the dictionary spec given by the index.
+	Dictionary *crypto.DictionarySpec `json:"dictionary_spec,omitempty"`
+	// Channels is the metadata given by the index that carries payload,
+	// and Encoding how the tracks do.
+	Channels Channels `json:"channels,omitempty"`
+	Encoding string   `json:"encoding,omitempty"`
+}
+
+// PartDir is where the playlists of an unfinished download are kept.
+func PartDir(filename, startPlaylistID string) string {
+	if filename == "" {
+		return startPlaylistID + ".spfs-part"
+	}
+	return filename + ".spfs-part"
+}
+
+func openProgress(dir, startPlaylistID string) (*downloadProgress, error) {
+	if dir == "" {
+		p := &downloadProgress{}
+		p.reset(startPlaylistID)
+		return p, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating download directory: %w", err)
+	}
+
+	p := &downloadProgress{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, progressFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("Error reading download progress: %w", err)
+		}
+		// Progress saved before Indexed existed only had Tracks.
+		p.Indexed = p.Indexed || p.Tracks != nil
+	}
+
+	if p.Start != startPlaylistID {
+		if p.Start != "" {
+			fmt.Printf("Discarding the unfinished download of %s found in %s\n", p.Start, dir)
+		}
+		p.reset(startPlaylistID)
+		return p, p.save()
+	}
+
+	// A part listed as completed must also exist on disk.
+	for sequence, done := range p.Completed {
+		if _, err := os.Stat(p.partPath(sequence)); done && err != nil {
+			p.Completed[sequence] = false
+		}
+	}
+	if n := p.count(); n > 0 {
+		fmt.Printf("Resuming download: %d of %d known playlist(s) already read\n", n, len(p.Playlists))
+	}
+	return p, nil
+}
+
+func (p *downloadProgress) reset(startPlaylistID string) {
+	for sequence := range p.Playlists {
+		os.Remove(p.partPath(sequence))
+	}
+	p.Start = startPlaylistID
+	p.Playlists = nil
+	p.Completed = nil
+	p.ChainComplete = false
+	p.Indexed = false
+	p.Tracks = nil
+	p.FEC = nil
+	p.Width = 0
+	p.Bytes = nil
+	p.Dictionary = nil
+	p.Channels = 0
+	p.Encoding = EncodingSubstitution
+}
+
+func (p *downloadProgress) partPath(sequence int) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%06d.part", sequence))
+}
+
+// save must be called with p.mu held, or before p is shared.
+func (p *downloadProgress) save() error {
+	if p.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(p.dir, progressFile), data)
+}
+
+// writeFileAtomic writes a file readable only by the current user, like the
+// journal, since the progress records the layout of the upload.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (p *downloadProgress) count() int {
+	n := 0
+	for _, done := range p.Completed {
+		if done {
+			n++
+		}
+	}
+	return n
+}
+
+// pending returns the known playlists that still have to be read.
+func (p *downloadProgress) pending() []ReadJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var jobs []ReadJob
+	for sequence, id := range p.Playlists {
+		if !p.Completed[sequence] {
+			j := ReadJob{Sequence: sequence, PlaylistID: id, Tracks: -1}
+			if sequence < len(p.Tracks) {
+				j.Tracks = p.Tracks[sequence]
+			}
+			if sequence < len(p.Bytes) {
+				j.Bytes = p.Bytes[sequence]
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs
+}
+
+func (p *downloadProgress) last() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Playlists) == 0 {
+		return "", false
+	}
+	return p.Playlists[len(p.Playlists)-1], p.ChainComplete
+}
+
+func (p *downloadProgress) addPlaylist(id string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, known := range p.Playlists {
+		if known == id {
+			return 0, fmt.Errorf("Playlist %s appears twice in the chain", id)
+		}
+	}
+	p.Playlists = append(p.Playlists, id)
+	p.Completed = append(p.Completed, false)
+	return len(p.Playlists) - 1, p.save()
+}
+
+func (p *downloadProgress) empty() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.Playlists) == 0
+}
+
+// setIndex records the whole chain at once from an upload's index.
+func (p *downloadProgress) setIndex(index Index, head IndexDescription) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Indexed = true
+	p.FEC = head.FEC
+	p.Dictionary = head.Dictionary
+	p.Channels = head.Channels
+	p.Encoding = head.Encoding
+	if head.Width > DefaultSymbolWidth {
+		p.Width = head.Width
+	}
+	for _, entry := range index.Playlists {
+		for _, known := range p.Playlists {
+			if known == entry.ID {
+				return fmt.Errorf("Playlist %s appears twice in the index", entry.ID)
+			}
+		}
+		p.Playlists = append(p.Playlists, entry.ID)
+		p.Completed = append(p.Completed, false)
+		p.Tracks = append(p.Tracks, entry.Tracks)
+		if recordsBytes(p.Width, p.Encoding) {
+			p.Bytes = append(p.Bytes, entry.Bytes)
+		}
+	}
+	p.ChainComplete = true
+	return p.save()
+}
+
+// check compares the track count of a playlist read with the one the index
+// recorded for it.
+func (p *downloadProgress) check(sequence, tracks int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sequence >= len(p.Tracks) || p.Tracks[sequence] == tracks {
+		return nil
+	}
+	return fmt.Errorf("%w: playlist %s holds %d tracks, expected %d", ErrIndexMismatch, p.Playlists[sequence], tracks, p.Tracks[sequence])
+}
+
+func (p *downloadProgress) setChainComplete() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ChainComplete = true
+	return p.save()
+}
+
+func (p *downloadProgress) complete(sequence int, data []byte) error {
+	if p.dir != "" {
+		if err := writeFileAtomic(p.partPath(sequence), data); err != nil {
+			return fmt.Errorf("Error saving playlist %d: %w", sequence, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Completed[sequence] = true
+	return p.save()
+}
+
+func (p *downloadProgress) done() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ChainComplete && p.count() == len(p.Playlists)
+}
+
+// assemble writes every part, in chain order, to w.
+func (p *downloadProgress) assemble(w io.Writer) error {
+	for sequence := range p.Playlists {
+		part, err := os.Open(p.partPath(sequence))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *downloadProgress) remove() error {
+	if p.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(p.dir)
+}
+
+// orderedWriter writes the playlists of a download kept in memory to w in
+// chain order as they arrive, holding back those read ahead of a gap.
+type orderedWriter struct {
+	w     io.Writer
+	next  int
+	parts map[int][]byte
+}
+
+func newOrderedWriter(w io.Writer) *orderedWriter {
+	return &orderedWriter{w: w, parts: make(map[int][]byte)}
+}
+
+func (o *orderedWriter) add(sequence int, data []byte) error {
+	o.parts[sequence] = data
+	for {
+		part, ok := o.parts[o.next]
+		if !ok {
+			return nil
+		}
+		delete(o.parts, o.next)
+		if _, err := o.w.Write(part); err != nil {
+			return err
+		}
+		o.next++
+	}
+}
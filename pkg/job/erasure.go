@@ -0,0 +1,159 @@
+package job
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"spotifyfs/pkg/fec"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultDataShards = 32
+
+	crcSize          = 4
+	blockLengthSize  = 2
+	minShardTrackLen = crcSize + 1
+)
+
+// FECParams sets the Reed-Solomon layout of every playlist of an upload: the
+// payload of a playlist is split into DataShards shards, ParityShards parity
+// shards are added, and every shard is stored followed by its CRC-32 so that
+// a damaged shard can be told apart from a good one. Any ParityShards shards
+// of a playlist may then be lost, e.g. to tracks that were removed, replaced
+// or that no longer decode.
+type FECParams struct {
+	DataShards   int `json:"k"`
+	ParityShards int `json:"m"`
+}
+
+func (p FECParams) String() string {
+	return fmt.Sprintf("%d:%d", p.DataShards, p.ParityShards)
+}
+
+// parseFECParams never returns nil, so that a garbled description gives
+// parameters that fail validation rather than no erasure code at all.
+func parseFECParams(s string) (*FECParams, error) {
+	var p FECParams
+	k, m, _ := strings.Cut(s, ":")
+	p.DataShards, _ = strconv.Atoi(k)
+	p.ParityShards, _ = strconv.Atoi(m)
+	return &p, p.validate()
+}
+
+func (p FECParams) validate() error {
+	shards := p.DataShards + p.ParityShards
+	if p.DataShards <= 0 || p.ParityShards <= 0 || shards > 256 {
+		return fmt.Errorf("Invalid erasure code %s: need at least one data and one parity shard, 256 in total at most", p)
+	}
+	if maxBytesPerPlaylist/shards < minShardTrackLen {
+		return fmt.Errorf("Invalid erasure code %s: too many shards for one playlist", p)
+	}
+	return nil
+}
+
+func (p FECParams) shards() int {
+	return p.DataShards + p.ParityShards
+}
+
+// BlockSize is how many payload bytes fit in a playlist holding capacity
+// bytes.
+func (p FECParams) BlockSize(capacity int) int {
+	shardSize := capacity/p.shards() - crcSize
+	return p.DataShards*shardSize - blockLengthSize
+}
+
+// encode lays out payload, at most BlockSize bytes, as the tracks of one
+// playlist. Shards are only as large as needed, so a short last block stays
+// short.
+func (p FECParams) encode(payload []byte) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	code, err := fec.NewCode(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	shardSize := max(1, (len(payload)+blockLengthSize+p.DataShards-1)/p.DataShards)
+	area := make([]byte, p.DataShards*shardSize)
+	binary.BigEndian.PutUint16(area, uint16(len(payload)))
+	copy(area[blockLengthSize:], payload)
+
+	shards := make([][]byte, p.shards())
+	for i := range shards {
+		if i < p.DataShards {
+			shards[i] = area[i*shardSize : (i+1)*shardSize]
+		} else {
+			shards[i] = make([]byte, shardSize)
+		}
+	}
+	if err := code.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, p.shards()*(shardSize+crcSize))
+	for _, shard := range shards {
+		out = append(out, shard...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(shard))
+	}
+	return out, nil
+}
+
+// decode rebuilds the payload of a playlist. erased marks the tracks that
+// could not be read at all; other damage is caught by the shard checksums.
+// It returns how many shards had to be rebuilt.
+func (p FECParams) decode(tracks []byte, erased []bool) ([]byte, int, error) {
+	if err := p.validate(); err != nil {
+		return nil, 0, err
+	}
+	stride := len(tracks) / p.shards()
+	if len(tracks)%p.shards() != 0 || stride < minShardTrackLen {
+		return nil, 0, fmt.Errorf("%w: %d tracks cannot hold %d shards", ErrIndexMismatch, len(tracks), p.shards())
+	}
+	shardSize := stride - crcSize
+
+	shards := make([][]byte, p.shards())
+	present := make([]bool, p.shards())
+	damaged := 0
+	for i := range shards {
+		start := i * stride
+		ok := true
+		for _, e := range erased[start : start+stride] {
+			ok = ok && !e
+		}
+		shard := tracks[start : start+shardSize]
+		if ok && binary.BigEndian.Uint32(tracks[start+shardSize:]) == crc32.ChecksumIEEE(shard) {
+			shards[i] = shard
+			present[i] = true
+		} else {
+			damaged++
+		}
+	}
+	if damaged > p.ParityShards {
+		return nil, damaged, fmt.Errorf("%w: %d of %d shards damaged, %d can be repaired", fec.ErrTooManyErasures, damaged, p.shards(), p.ParityShards)
+	}
+
+	code, err := fec.NewCode(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, damaged, err
+	}
+	if err := code.Reconstruct(shards, present); err != nil {
+		return nil, damaged, err
+	}
+
+	area := make([]byte, 0, p.DataShards*shardSize)
+	for _, shard := range shards[:p.DataShards] {
+		area = append(area, shard...)
+	}
+	if len(area) < blockLengthSize {
+		return nil, damaged, errors.New("Erasure coded block is too short")
+	}
+	length := int(binary.BigEndian.Uint16(area))
+	if length > len(area)-blockLengthSize {
+		return nil, damaged, errors.New("Erasure coded block length is out of range")
+	}
+	return area[blockLengthSize : blockLengthSize+length], damaged, nil
+}
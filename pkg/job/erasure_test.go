@@ -0,0 +1,87 @@
+package job
+
+import (
+	"bytes"
+	"errors"
+	"spotifyfs/pkg/fec"
+	"testing"
+)
+
+func TestFECParamsRoundTrip(t *testing.T) {
+	tests := []FECParams{
+		{DataShards: 1, ParityShards: 1},
+		{DataShards: 3, ParityShards: 2},
+		{DataShards: DefaultDataShards, ParityShards: 4},
+		{DataShards: 200, ParityShards: 56},
+	}
+	for _, p := range tests {
+		parsed, err := parseFECParams(p.String())
+		if err != nil || *parsed != p {
+			t.Fatalf("parseFECParams(%q) = %v, %v", p, parsed, err)
+		}
+
+		blockSize := p.BlockSize(maxBytesPerPlaylist)
+		for _, n := range []int{0, 1, blockSize / 2, blockSize} {
+			payload := testData(n)
+			tracks, err := p.encode(payload)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", p, n, err)
+			}
+			if n == blockSize && len(tracks) > maxBytesPerPlaylist {
+				t.Fatalf("%s: a full block takes %d tracks", p, len(tracks))
+			}
+			stride := len(tracks) / p.shards()
+
+			// Lose the first m shards, then the last m, then one more.
+			for _, erasures := range [][]int{
+				nil,
+				span(0, p.ParityShards),
+				span(p.shards()-p.ParityShards, p.shards()),
+				span(0, p.ParityShards+1),
+			} {
+				damaged := bytes.Clone(tracks)
+				erased := make([]bool, len(tracks))
+				for i, shard := range erasures {
+					// Alternate between tracks that are gone and
+					// tracks that fail the checksum.
+					if i%2 == 0 {
+						erased[shard*stride] = true
+					} else {
+						damaged[shard*stride] ^= 0xff
+					}
+				}
+
+				got, repaired, err := p.decode(damaged, erased)
+				if len(erasures) > p.ParityShards {
+					if !errors.Is(err, fec.ErrTooManyErasures) {
+						t.Fatalf("%s, %d bytes, %d shards lost: got %v, want ErrTooManyErasures", p, n, len(erasures), err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s, %d bytes, %d shards lost: %v", p, n, len(erasures), err)
+				}
+				if repaired != len(erasures) || !bytes.Equal(got, payload) {
+					t.Fatalf("%s, %d bytes, %d shards lost: %d repaired, payload equal %v", p, n, len(erasures), repaired, bytes.Equal(got, payload))
+				}
+			}
+		}
+	}
+}
+
+func TestParseFECParamsRejectsGarbage(t *testing.T) {
+	for _, s := range []string{"", "32", "0:4", "32:0", "200:57", "x:y", "5000:1"} {
+		p, err := parseFECParams(s)
+		if err == nil || p == nil {
+			t.Errorf("parseFECParams(%q) = %v, %v", s, p, err)
+		}
+	}
+}
+
+func span(from, to int) []int {
+	var s []int
+	for i := from; i < to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
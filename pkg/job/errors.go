@@ -0,0 +1,34 @@
+package job
+
+import "fmt"
+
+// ErrUnknownTrack reports a track that is not part of the dictionary, which
+// means the playlist was modified or the wrong password or decoder was used.
+type ErrUnknownTrack struct {
+	PlaylistID string
+	Position   int
+	URI        string
+}
+
+func (e *ErrUnknownTrack) Error() string {
+	return fmt.Sprintf("Unknown track %s at position %d of playlist %s", e.URI, e.Position, e.PlaylistID)
+}
+
+// ErrPlaylistFetch reports a playlist whose tracks could not be fetched from
+// Spotify, after the request executor gave up retrying.
+type ErrPlaylistFetch struct {
+	PlaylistID string
+	Err        error
+}
+
+func (e *ErrPlaylistFetch) Error() string {
+	if notFound(e.Err) {
+		// Spotify answers the same for private playlists of other users.
+		return fmt.Sprintf("Playlist %s not found, it does not exist or is private to another account: %v", e.PlaylistID, e.Err)
+	}
+	return fmt.Sprintf("Error fetching playlist %s: %v", e.PlaylistID, e.Err)
+}
+
+func (e *ErrPlaylistFetch) Unwrap() error {
+	return e.Err
+}
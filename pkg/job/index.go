@@ -0,0 +1,346 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"spotifyfs/pkg/crypto"
+	"spotifyfs/pkg/spotify"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	IndexMarker  = "spotifyfs:index"
+	IndexVersion = 1
+
+	// maxDescriptionLength is the longest description Spotify keeps.
+	maxDescriptionLength = 300
+	playlistIDLength     = 22
+)
+
+var (
+	ErrIndexVersion  = errors.New("Unsupported index version")
+	ErrIndexMismatch = errors.New("Playlist does not match the index")
+)
+
+// IndexDescription is the description of an index playlist. Data points at
+// the first data playlist so that the chain can still be walked without the
+// password, Next at the following index playlist when the index does not fit
+// in one, and Part numbers the index playlists from 0 (the head). FEC is the
+// erasure code of every playlist of the upload, index included. Width is the
+// symbol width of the data playlists and Dictionary how the dictionary is
+// searched for, nil for crypto.SequentialDictionarySpec; both have to be
+// known before any track is decoded, so they cannot live in the stream
+// header. Channels is the metadata that carries payload in data playlists
+// and Encoding how their tracks do. The head also gives the size of the file,
+// the number of playlists of the upload and when it started, so that uploads
+// can be listed without the password; they are zero for older uploads.
+type IndexDescription struct {
+	Version    int
+	Data       string
+	Next       string
+	Part       int
+	FEC        *FECParams
+	Width      int
+	Dictionary *crypto.DictionarySpec
+	Channels   Channels
+	Encoding   string
+	Size       int64
+	Playlists  int
+	Created    time.Time
+}
+
+func (d IndexDescription) String() string {
+	fields := []string{IndexMarker, "v=" + strconv.Itoa(d.Version)}
+	if d.Part > 0 {
+		fields = append(fields, "p="+strconv.Itoa(d.Part))
+	}
+	if d.FEC != nil {
+		fields = append(fields, "e="+d.FEC.String())
+	}
+	if d.Width > DefaultSymbolWidth {
+		fields = append(fields, "w="+strconv.Itoa(d.Width))
+	}
+	if d.Dictionary != nil {
+		fields = append(fields, dictionaryFields(*d.Dictionary)...)
+	}
+	if d.Channels != 0 {
+		fields = append(fields, "m="+d.Channels.field())
+	}
+	if d.Encoding != EncodingSubstitution {
+		fields = append(fields, "x="+d.Encoding)
+	}
+	if d.Size > 0 {
+		fields = append(fields, "s="+strconv.FormatInt(d.Size, 10))
+	}
+	if d.Playlists > 0 {
+		fields = append(fields, "c="+strconv.Itoa(d.Playlists))
+	}
+	if !d.Created.IsZero() {
+		fields = append(fields, "t="+strconv.FormatInt(d.Created.Unix(), 10))
+	}
+	if d.Data != "" {
+		fields = append(fields, "d="+d.Data)
+	}
+	if d.Next != "" {
+		fields = append(fields, "n="+d.Next)
+	}
+	return strings.Join(fields, ";")
+}
+
+// ParseIndexDescription reports whether description belongs to an index
+// playlist. Spotify returns descriptions HTML escaped, which is undone first.
+func ParseIndexDescription(description string) (IndexDescription, bool) {
+	fields := strings.Split(html.UnescapeString(strings.TrimSpace(description)), ";")
+	if fields[0] != IndexMarker {
+		return IndexDescription{}, false
+	}
+
+	var d IndexDescription
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "v":
+			d.Version, _ = strconv.Atoi(value)
+		case "p":
+			d.Part, _ = strconv.Atoi(value)
+		case "d":
+			d.Data = value
+		case "n":
+			d.Next = value
+		case "e":
+			d.FEC, _ = parseFECParams(value)
+		case "w":
+			// A garbled width stays invalid rather than falling back to 8.
+			if d.Width, _ = strconv.Atoi(value); d.Width == 0 {
+				d.Width = -1
+			}
+		case "m":
+			d.Channels = parseChannelsField(value)
+		case "x":
+			d.Encoding = value
+		case "s":
+			d.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "c":
+			d.Playlists, _ = strconv.Atoi(value)
+		case "t":
+			if created, err := strconv.ParseInt(value, 10, 64); err == nil {
+				d.Created = time.Unix(created, 0)
+			}
+		case "g", "r", "o", "mk", "ql", "cs", "st", "h":
+			if d.Dictionary == nil {
+				spec := crypto.SequentialDictionarySpec()
+				d.Dictionary = &spec
+			}
+			parseDictionaryField(d.Dictionary, key, value)
+		}
+	}
+	return d, true
+}
+
+// dictionaryFields records the parts of spec that differ from
+// crypto.SequentialDictionarySpec, which older uploads implicitly use.
+func dictionaryFields(spec crypto.DictionarySpec) []string {
+	base := crypto.SequentialDictionarySpec()
+	var fields []string
+	if spec.Market != base.Market {
+		fields = append(fields, "mk="+spec.Market)
+	}
+	if spec.QueryLength != base.QueryLength {
+		fields = append(fields, "ql="+strconv.Itoa(spec.QueryLength))
+	}
+	if spec.Charset != base.Charset {
+		fields = append(fields, "cs="+url.QueryEscape(spec.Charset))
+	}
+	if spec.SearchType != base.SearchType {
+		fields = append(fields, "st="+spec.SearchType)
+	}
+	if spec.Offset != base.Offset {
+		fields = append(fields, "o="+strconv.Itoa(spec.Offset))
+	}
+	if spec.Results != base.Results {
+		fields = append(fields, "r="+strconv.Itoa(spec.Results))
+	}
+	if spec.Homophones != base.Homophones {
+		fields = append(fields, "h="+strconv.Itoa(spec.Homophones))
+	}
+	return fields
+}
+
+// parseDictionaryField sets one field of spec. Garbled numbers give values
+// that fail validation rather than the defaults.
+func parseDictionaryField(spec *crypto.DictionarySpec, key, value string) {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		number = -1
+	}
+	switch key {
+	case "g":
+		// Dictionary versions, written before the spec was.
+		preset, err := crypto.DictionarySpecVersion(number)
+		if err != nil {
+			spec.Results = -1
+			return
+		}
+		spec.Results = preset.Results
+	case "r":
+		spec.Results = number
+	case "o":
+		spec.Offset = number
+	case "mk":
+		spec.Market = value
+	case "ql":
+		spec.QueryLength = number
+	case "cs":
+		if spec.Charset, err = url.QueryUnescape(value); err != nil {
+			spec.Charset = ""
+		}
+	case "st":
+		spec.SearchType = value
+	case "h":
+		spec.Homophones = number
+	}
+}
+
+// checkDescriptionLength makes sure the description of every index playlist
+// of an upload laid out like d will fit, before anything is written: the
+// head, which also summarizes the upload, and the ones after it.
+func checkDescriptionLength(d IndexDescription) error {
+	d.Version = IndexVersion
+	d.Data = strings.Repeat("x", playlistIDLength)
+	d.Next = strings.Repeat("x", playlistIDLength)
+	head := d
+	head.Size, head.Playlists, head.Created = math.MaxInt64, 99999, time.Now()
+	d.Part = 9999
+	longest := max(len(head.String()), len(d.String()))
+	if longest > maxDescriptionLength {
+		return fmt.Errorf("The dictionary spec does not fit in a playlist description (%d of %d characters), use a shorter charset", longest, maxDescriptionLength)
+	}
+	return nil
+}
+
+// Index is the superblock stored in the tracks of the index playlists. It
+// lists every data playlist in order so that all of them can be read at once.
+type Index struct {
+	Version   int          `json:"v"`
+	Playlists []IndexEntry `json:"playlists"`
+}
+
+type IndexEntry struct {
+	ID     string `json:"id"`
+	Tracks int    `json:"n"`
+	Bytes  int    `json:"b,omitempty"`
+}
+
+func newIndex(journal *Journal) Index {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	index := Index{Version: IndexVersion}
+	for _, p := range journal.Playlists {
+		entry := IndexEntry{ID: p.ID, Tracks: p.Length}
+		if recordsBytes(journal.Width, journal.Encoding) {
+			entry.Bytes = p.Bytes
+		}
+		index.Playlists = append(index.Playlists, entry)
+	}
+	return index
+}
+
+// readIndex reads the index whose head playlist has the given description.
+func readIndex(ctx context.Context, s *spotify.SpotifyClient, headID string, head IndexDescription, dictionary *crypto.Dictionary) (Index, error) {
+	if head.Version != IndexVersion {
+		return Index{}, fmt.Errorf("%w: %d", ErrIndexVersion, head.Version)
+	}
+
+	var data []byte
+	playlistID, description := headID, head
+	seen := map[string]bool{}
+	for {
+		if seen[playlistID] {
+			return Index{}, fmt.Errorf("Playlist %s appears twice in the index", playlistID)
+		}
+		seen[playlistID] = true
+
+		part, _, _, err := decodePlaylist(ctx, s, playlistID, dictionary, DefaultSymbolWidth, 0, -1, head.FEC)
+		if err != nil {
+			return Index{}, err
+		}
+		data = append(data, part...)
+
+		if description.Next == "" {
+			break
+		}
+		playlistID = description.Next
+		details, err := s.GetPlaylistDetails(ctx, playlistID)
+		if err != nil {
+			return Index{}, &ErrPlaylistFetch{PlaylistID: playlistID, Err: err}
+		}
+		var ok bool
+		if description, ok = ParseIndexDescription(details.Description); !ok {
+			return Index{}, fmt.Errorf("Playlist %s is not part of the index", playlistID)
+		}
+	}
+
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return Index{}, fmt.Errorf("Error reading index: %w", err)
+	}
+	if index.Version != IndexVersion {
+		return Index{}, fmt.Errorf("%w: %d", ErrIndexVersion, index.Version)
+	}
+	if len(index.Playlists) == 0 {
+		return Index{}, errors.New("Index lists no playlists")
+	}
+	for _, entry := range index.Playlists {
+		if recordsBytes(head.Width, head.Encoding) && entry.Bytes <= 0 && entry.Tracks > 0 {
+			return Index{}, fmt.Errorf("Index gives no length for playlist %s", entry.ID)
+		}
+	}
+	return index, nil
+}
+
+// nextInChain returns the playlist that follows one with the given
+// description: the next index playlist, the first data playlist after the
+// last index playlist, or the next data playlist.
+func nextInChain(description string) string {
+	if d, ok := ParseIndexDescription(description); ok {
+		if d.Next != "" {
+			return d.Next
+		}
+		return d.Data
+	}
+	if description == "null" {
+		return ""
+	}
+	next, _, _ := parseDataDescription(description)
+	return next
+}
+
+// WalkChain visits every playlist of an upload, index playlists first, by
+// following descriptions. It does not need the password.
+func WalkChain(ctx context.Context, s *spotify.SpotifyClient, playlistID string, visit func(spotify.PlaylistDetails) error) error {
+	seen := map[string]bool{}
+	for playlistID != "" {
+		if seen[playlistID] {
+			return fmt.Errorf("Playlist %s appears twice in the chain", playlistID)
+		}
+		seen[playlistID] = true
+
+		details, err := s.GetPlaylistDetails(ctx, playlistID)
+		if err != nil {
+			return err
+		}
+		if err := visit(details); err != nil {
+			return err
+		}
+		playlistID = nextInChain(details.Description)
+	}
+	return nil
+}
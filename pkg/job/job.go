@@ -1,302 +1,1192 @@
 package job
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	mathRand "math/rand/v2"
-	"net/http"
 	"os"
 	"spotifyfs/pkg/crypto"
+	"spotifyfs/pkg/fec"
 	"spotifyfs/pkg/spotify"
-	"strconv"
 	"sync"
-	"time"
 )
 
 const (
 	numWorkers          = 3
 	maxBytesPerPlaylist = 10000
+	// maxBatchAttempts is how many times a batch of tracks is sent when
+	// the requests fail without telling whether they were applied.
+	maxBatchAttempts = 3
 )
 
 type WriteJob struct {
+	Chain      Chain
+	Sequence   int
 	PlaylistID string
-	Chunks     [][]byte
+	Tracks     []string
+	// Done is the number of tracks the playlist already holds, from an
+	// earlier run that was interrupted.
+	Done int
+}
+
+type WriteOptions struct {
+	// Resume continues the upload recorded in the playlist's journal
+	// instead of starting a new one.
+	Resume bool
+	// Compression is CompressionAuto (the default), CompressionGzip or
+	// CompressionNone. A resumed upload keeps the mode it started with.
+	Compression string
+	// ParityShards adds that many Reed-Solomon parity shards to every
+	// playlist, split into DataShards data shards (DefaultDataShards when
+	// 0). 0 writes no erasure code.
+	ParityShards int
+	DataShards   int
+	// SymbolWidth is the number of bits each track carries, 8
+	// (DefaultSymbolWidth, when 0) to 16. Wider symbols need fewer tracks
+	// but a dictionary of 1<<SymbolWidth tracks.
+	SymbolWidth int
+	// DictionaryCache is the directory generated dictionaries are cached
+	// in, "" for none.
+	DictionaryCache string
+	// Dictionary is how the dictionary is searched for,
+	// crypto.DefaultDictionarySpec when nil. A resumed upload keeps the
+	// one it started with.
+	Dictionary *crypto.DictionarySpec
+	// Channels also stores payload in the description and the cover of
+	// data playlists. A resumed upload keeps the ones it started with.
+	Channels Channels
+	// Encoding is how data playlists hold their payload in their tracks,
+	// EncodingSubstitution or EncodingPermutation. Permutations cannot be
+	// erasure coded.
+	Encoding string
+	// Visibility is VisibilityPrivate (the default, when ""),
+	// VisibilityPublic or VisibilityCollaborative. A resumed upload keeps the
+	// one it started with.
+	Visibility string
+	// Journal is where Put records its progress, "" to keep it in memory
+	// only, in which case the upload cannot be resumed.
+	Journal string
+	// Decoder is where Put saves the dictionary, "" for nowhere. A resumed
+	// upload loads it from there.
+	Decoder string
+}
+
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (f *firstError) Set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *firstError) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 type ReadJob struct {
 	Sequence   int
 	PlaylistID string
+	// Bytes is the payload length of playlists with symbols wider than 8
+	// bits or a permutation, which the track count alone does not give.
+	Bytes int
+	// Tracks is the track count the index records, -1 when unknown.
+	Tracks int
 }
 
 type ReadResult struct {
 	Sequence int
 	Data     []byte
-	NextID   string
+	// Tracks is the number of tracks the playlist holds, Damaged the
+	// number of erasure code shards that had to be rebuilt.
+	Tracks  int
+	Damaged int
+	// Err is set when the playlist could not be read completely, in which
+	// case Data must not be used.
+	Err error
 }
 
-func WriterWorker(ctx context.Context, s *spotify.SpotifyClient, job <-chan WriteJob, writerdictionary map[byte]string, wg *sync.WaitGroup) {
+func WriterWorker(ctx context.Context, s *spotify.SpotifyClient, job <-chan WriteJob, dictionary *crypto.Dictionary, journal *Journal, failed *firstError, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for j := range job {
-		for i, chunk := range j.Chunks {
-			musicsURI := make([]string, len(chunk))
-			for idx, b := range chunk {
-				musicsURI[idx] = writerdictionary[b]
-			}
+		if err := addTracks(ctx, s, j, dictionary, journal); err != nil {
+			log.Printf("[Worker] %v", err)
+			failed.Set(err)
+			continue
+		}
+		fmt.Printf("Successfully finished all chunks for playlist %s\n", j.PlaylistID)
+	}
+}
+
+// addTracks adds the tracks of j in batches. A batch whose request may have
+// been applied is only sent again once the playlist shows it was not, so
+// that no track is ever added twice.
+func addTracks(ctx context.Context, s *spotify.SpotifyClient, j WriteJob, dictionary *crypto.Dictionary, journal *Journal) error {
+	for start := j.Done; start < len(j.Tracks); start += spotify.SpotifyMaxTracksPerRequest {
+		end := min(start+spotify.SpotifyMaxTracksPerRequest, len(j.Tracks))
+		addPlaylistURIS := spotify.SpotifyAddPlaylist{
+			MusicURIS: j.Tracks[start:end],
+		}
 
-			addPlaylistURIS := spotify.SpotifyAddPlaylist{
-				MusicURIS: musicsURI,
+		var err error
+		for attempt := 1; ; attempt++ {
+			err = s.AddToPlaylist(ctx, addPlaylistURIS, j.PlaylistID)
+			if !errors.Is(err, spotify.ErrMaybeApplied) {
+				break
+			}
+			applied, checkErr := batchApplied(ctx, s, j.PlaylistID, start, end)
+			if checkErr != nil {
+				err = checkErr
+				break
+			}
+			if applied {
+				err = nil
+				break
 			}
+			if attempt == maxBatchAttempts {
+				break
+			}
+			log.Printf("[Worker] %v. Tracks %d-%d were not added, sending them again", err, start, end)
+		}
+		if err != nil {
+			return fmt.Errorf("Error adding tracks %d-%d to playlist %s: %w", start, end, j.PlaylistID, err)
+		}
+		if err := journal.SetTracks(j.Chain, j.Sequence, end); err != nil {
+			log.Printf("[Worker] %v", err)
+		}
+	}
+	return nil
+}
 
-			for {
-				err := s.AddToPlaylist(ctx, addPlaylistURIS, j.PlaylistID)
-				if err == nil {
-					break
-				}
+// batchApplied tells from the track count of a playlist whether the batch of
+// tracks start to end was added to it.
+func batchApplied(ctx context.Context, s *spotify.SpotifyClient, playlistID string, start, end int) (bool, error) {
+	details, err := s.GetPlaylistDetails(ctx, playlistID)
+	if err != nil {
+		return false, err
+	}
+	switch details.Tracks.Total {
+	case end:
+		return true, nil
+	case start:
+		return false, nil
+	}
+	return false, fmt.Errorf("Playlist %s holds %d tracks, expected %d or %d", playlistID, details.Tracks.Total, start, end)
+}
 
-				log.Printf("[Worker] Critical error adding chunk %d to playlist %s: %v", i, j.PlaylistID, err)
-				time.Sleep(1 * time.Second)
-			}
+// openJournal starts a new journal, or loads the existing one when resuming
+// after checking that it belongs to the same file.
+func openJournal(path, filepath, playlistName string, manifest Manifest, resume bool) (*Journal, error) {
+	if path == "" {
+		if resume {
+			return nil, errors.New("Only an upload with a journal can be resumed")
 		}
-		fmt.Printf("Successfully finished all chunks for playlist %s\n", j.PlaylistID)
+		return NewJournal("", filepath, playlistName, manifest), nil
 	}
+
+	existing, err := LoadJournal(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if !resume {
+		// A journal that created no playlist yet, e.g. because the
+		// options were rejected, has nothing to orphan.
+		if existing != nil && !existing.Complete && len(existing.Playlists)+len(existing.Index) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnfinishedUpload, path)
+		}
+		journal := NewJournal(path, filepath, playlistName, manifest)
+		return journal, journal.Save()
+	}
+
+	if existing == nil {
+		return nil, fmt.Errorf("No journal to resume from at %s", path)
+	}
+	if existing.Manifest.Size != manifest.Size || existing.Manifest.SHA256 != manifest.SHA256 {
+		return nil, fmt.Errorf("%s changed since the upload recorded in %s started", filepath, path)
+	}
+	return existing, nil
 }
 
-func Writer(s *spotify.SpotifyClient, filepath string, password string, playlistName string) {
-	ctx := context.Background()
-	writerdictionary, readerdictionary, err := crypto.NewDictionary(ctx, password, s)
+func loadWriterDictionary(ctx context.Context, s *spotify.SpotifyClient, password, decoderFile string, opts crypto.DictionaryOptions, resume bool) (*crypto.Dictionary, error) {
+	if resume && decoderFile != "" {
+		dictionary, err := crypto.LoadDictionary(decoderFile, password)
+		if err == nil {
+			err = checkDictionary(dictionary, opts)
+		}
+		if err == nil {
+			return dictionary, nil
+		}
+		log.Printf("Cannot reuse decoder map %s, generating the dictionary again: %v", decoderFile, err)
+	}
+
+	dictionary, err := crypto.NewDictionary(ctx, password, s, opts)
 	if err != nil {
-		fmt.Printf("Error initializing dictionary: %v\n", err)
-		return
+		return nil, fmt.Errorf("Error initializing dictionary: %w", err)
+	}
+	if decoderFile == "" {
+		return dictionary, nil
 	}
 
 	fmt.Println("Saving map to file...")
-	decoderFile := playlistName + "_Decoder.gob"
-	if err := crypto.SaveMap(decoderFile, readerdictionary, password); err != nil {
-		fmt.Printf("Error saving decoder map: %v\n", err)
-		return
+	if err := crypto.SaveDictionary(decoderFile, dictionary, password); err != nil {
+		return nil, fmt.Errorf("Error saving decoder map: %w", err)
 	}
+	return dictionary, nil
+}
+
+// chainSpec describes one chain of playlists written by writeChain.
+type chainSpec struct {
+	Chain  Chain
+	Stream io.Reader
+	FEC    *FECParams
+	Width  int
+	// Channels is the metadata that carries payload besides the tracks,
+	// Encoding how the tracks carry theirs.
+	Channels Channels
+	Encoding string
+	Name     func(sequence int) string
+	// Description returns the description of a playlist given the ID of
+	// the one that follows it, or "" for the last one, and the payload of
+	// its description channel.
+	Description func(sequence int, next string, payload []byte) string
+}
 
+// Writer uploads the file at filepath to playlists named after playlistName,
+// with a journal and a decoder file named after it, and returns the ID of the
+// index head.
+func Writer(s *spotify.SpotifyClient, filepath string, password string, playlistName string, opts WriteOptions) (string, error) {
 	file, err := os.Open(filepath)
 	if err != nil {
-		log.Printf("Error opening file: %v\n", err)
-		return
+		return "", fmt.Errorf("Error opening file: %w", err)
 	}
 	defer file.Close()
 
+	manifest, err := NewManifest(file)
+	if err != nil {
+		return "", err
+	}
+
+	opts.Journal = JournalPath(playlistName)
+	opts.Decoder = playlistName + "_Decoder.gob"
+	return Put(context.Background(), s, file, manifest, password, playlistName, opts)
+}
+
+// Put uploads what r yields, described by manifest, to playlists named after
+// playlistName and returns the ID of the index head. A manifest that is
+// Streamed gets the size of the data in the index once it is read. Data is
+// read as it is uploaded, so resuming a Streamed upload needs the same data
+// again, which cannot be checked beforehand.
+func Put(ctx context.Context, s *spotify.SpotifyClient, r io.Reader, manifest Manifest, password, playlistName string, opts WriteOptions) (string, error) {
+	journalPath := opts.Journal
+	journal, err := openJournal(journalPath, manifest.Name, playlistName, manifest, opts.Resume)
+	if err != nil {
+		return "", err
+	}
+	if journal.Complete {
+		fmt.Println("The upload recorded in the journal is already complete.")
+		return journal.Handle(), nil
+	}
+
+	// The header must be byte for byte the one of the interrupted run.
+	header, err := journal.Manifest.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("Error encoding manifest: %w", err)
+	}
+	input := bufio.NewReaderSize(r, compressionSample)
+	data := &countingReader{r: input}
+	plain, err := compressStream(journal, input, opts.Compression, io.MultiReader(bytes.NewReader(header), data))
+	if err != nil {
+		return "", err
+	}
+	defer plain.Close()
+	stream, err := encryptStream(journal, password, plain)
+	if err != nil {
+		return "", err
+	}
+
+	if len(journal.Playlists) == 0 && opts.ParityShards > 0 {
+		fecParams := &FECParams{DataShards: opts.DataShards, ParityShards: opts.ParityShards}
+		if fecParams.DataShards == 0 {
+			fecParams.DataShards = DefaultDataShards
+		}
+		if err := fecParams.validate(); err != nil {
+			return "", err
+		}
+		if err := journal.SetFEC(fecParams); err != nil {
+			return "", err
+		}
+	}
+
+	if len(journal.Playlists) == 0 {
+		width := opts.SymbolWidth
+		if width == 0 {
+			width = DefaultSymbolWidth
+		}
+		if err := validWidth(width); err != nil {
+			return "", err
+		}
+		spec := crypto.DefaultDictionarySpec()
+		if opts.Dictionary != nil {
+			spec = *opts.Dictionary
+		}
+		if spec.Homophones == 1 {
+			// Recorded like dictionaries from before homophones.
+			spec.Homophones = 0
+		}
+		if err := spec.Validate(); err != nil {
+			return "", err
+		}
+		if err := opts.Channels.validate(); err != nil {
+			return "", err
+		}
+		encoding, err := ParseEncoding(opts.Encoding)
+		if err != nil {
+			return "", err
+		}
+		visibility, err := ParseVisibility(opts.Visibility)
+		if err != nil {
+			return "", err
+		}
+		if encoding == EncodingPermutation && journal.FEC != nil {
+			return "", errors.New("Permutations cannot be erasure coded, a missing track loses the order of the whole playlist: disable parity")
+		}
+		if err := checkDescriptionLength(IndexDescription{FEC: journal.FEC, Width: width, Dictionary: &spec, Channels: opts.Channels, Encoding: encoding}); err != nil {
+			return "", err
+		}
+		if err := journal.SetDictionary(width, spec); err != nil {
+			return "", err
+		}
+		if err := journal.SetChannels(opts.Channels); err != nil {
+			return "", err
+		}
+		if err := journal.SetEncoding(encoding); err != nil {
+			return "", err
+		}
+		if err := journal.SetVisibility(visibility); err != nil {
+			return "", err
+		}
+	}
+	dictionaryOpts, err := journal.DictionaryOptions()
+	if err != nil {
+		return "", err
+	}
+	dictionaryOpts.CacheDir = opts.DictionaryCache
+	width := dictionaryOpts.Width
+
+	dictionary, err := loadWriterDictionary(ctx, s, password, opts.Decoder, dictionaryOpts, opts.Resume)
+	if err != nil {
+		return "", err
+	}
+
+	writeErr := writeChain(ctx, s, chainSpec{
+		Chain:    DataChain,
+		Stream:   stream,
+		FEC:      journal.FEC,
+		Width:    width,
+		Channels: journal.Channels,
+		Encoding: journal.Encoding,
+		Name: func(sequence int) string {
+			return fmt.Sprintf("%s%d", playlistName, sequence+1)
+		},
+		Description: func(sequence int, next string, payload []byte) string {
+			return dataDescription(next, payload)
+		},
+	}, dictionary, journal)
+
+	if writeErr == nil {
+		fmt.Println("Data playlists complete. Writing the index...")
+		size := journal.Manifest.Size
+		if journal.Manifest.Streamed {
+			size = data.n
+		}
+		writeErr = writeIndex(ctx, s, playlistName, dictionary, journal, size)
+	}
+	if writeErr != nil && journalPath != "" {
+		return journal.Handle(), fmt.Errorf("%w (progress saved in %s, run again with resume to continue)", writeErr, journalPath)
+	}
+	if writeErr != nil {
+		return journal.Handle(), writeErr
+	}
+	if err := journal.SetComplete(); err != nil {
+		return journal.Handle(), err
+	}
+	fmt.Println("All songs were added to the linked playlists successfully.")
+	return journal.Handle(), nil
+}
+
+// compressStream puts r, which starts with the manifest, behind a compression
+// header when the data input holds compresses. The decision is kept in the
+// journal.
+func compressStream(journal *Journal, input *bufio.Reader, mode string, r io.Reader) (io.ReadCloser, error) {
+	if len(journal.Playlists) == 0 {
+		compression, err := chooseCompression(input, mode)
+		if err != nil {
+			return nil, err
+		}
+		if err := journal.SetCompression(compression); err != nil {
+			return nil, err
+		}
+	}
+	if journal.Compression != CompressionGzip {
+		return io.NopCloser(r), nil
+	}
+
+	header, err := Manifest{Compression: CompressionGzip}.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding compression header: %w", err)
+	}
+	compressed := compressReader(r)
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(header), compressed), compressed}, nil
+}
+
+// encryptStream puts r, which starts with a header, behind an encryption
+// header. Uploads journaled before encryption existed are resumed as they
+// were started.
+func encryptStream(journal *Journal, password string, r io.Reader) (io.Reader, error) {
+	params := journal.Encryption
+	if params == nil {
+		if len(journal.Playlists) > 0 {
+			return r, nil
+		}
+		fresh, err := crypto.NewStreamParams()
+		if err != nil {
+			return nil, fmt.Errorf("Error generating encryption parameters: %w", err)
+		}
+		params = &fresh
+	}
+
+	key, err := params.Key(password)
+	if err != nil {
+		return nil, err
+	}
+	keyCheck := crypto.KeyCheck(key)
+	if journal.KeyCheck != "" && journal.KeyCheck != keyCheck {
+		return nil, errors.New("The password is not the one the journaled upload was started with")
+	}
+	if journal.Encryption == nil {
+		if err := journal.SetEncryption(*params, keyCheck); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := Manifest{Encryption: params}.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding encryption header: %w", err)
+	}
+	encrypted, err := crypto.NewEncryptReader(r, key, *params, header)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(header), encrypted), nil
+}
+
+// writeIndex stores the list of data playlists in one or more index
+// playlists. The head carries the upload's name and is the handle returned to
+// the user. The index always uses 8-bit symbols, which the first 256 entries
+// of a dictionary of any width decode.
+func writeIndex(ctx context.Context, s *spotify.SpotifyClient, playlistName string, dictionary *crypto.Dictionary, journal *Journal, size int64) error {
+	index, err := json.Marshal(newIndex(journal))
+	if err != nil {
+		return fmt.Errorf("Error encoding index: %w", err)
+	}
+	dataHead := journal.PlaylistIDs(DataChain)[0]
+
+	spec := chainSpec{
+		Chain:  IndexChain,
+		Stream: bytes.NewReader(index),
+		FEC:    journal.FEC,
+		Width:  DefaultSymbolWidth,
+		Name: func(sequence int) string {
+			if sequence == 0 {
+				return playlistName
+			}
+			return fmt.Sprintf("%s index %d", playlistName, sequence+1)
+		},
+	}
+	// The head summarizes the upload for listings.
+	blockSize := spec.blockSize(dictionary)
+	playlists := len(journal.Playlists) + (len(index)+blockSize-1)/blockSize
+	spec.Description = func(sequence int, next string, payload []byte) string {
+		d := IndexDescription{
+			Version:    IndexVersion,
+			Data:       dataHead,
+			Next:       next,
+			Part:       sequence,
+			FEC:        journal.FEC,
+			Width:      journal.Width,
+			Dictionary: &dictionary.Spec,
+			Channels:   journal.Channels,
+			Encoding:   journal.Encoding,
+		}
+		if sequence == 0 {
+			d.Size, d.Playlists, d.Created = size, playlists, journal.Created
+		}
+		return d.String()
+	}
+	return writeChain(ctx, s, spec, dictionary, journal)
+}
+
+// blockSize is how many bytes of the stream the tracks of one playlist hold:
+// maxBytesPerPlaylist tracks of spec.Width bits, erasure coded when spec.FEC
+// is set, or permutations of as many distinct dictionary entries.
+func (spec chainSpec) blockSize(dictionary *crypto.Dictionary) int {
+	if spec.Encoding == EncodingPermutation {
+		return permutationCapacity(min(len(dictionary.Entries(spec.Width)), maxBytesPerPlaylist))
+	}
+	if spec.FEC != nil {
+		return spec.FEC.BlockSize(playlistCapacity(spec.Width))
+	}
+	return playlistCapacity(spec.Width)
+}
+
+// writeChain splits spec.Stream into playlists holding spec.blockSize bytes
+// in their tracks after what spec.Channels carries, linking each one from
+// the description of the previous one. Playlists, covers and tracks already
+// recorded in the journal are not written again.
+func writeChain(ctx context.Context, s *spotify.SpotifyClient, spec chainSpec, dictionary *crypto.Dictionary, journal *Journal) error {
 	jobs := make(chan WriteJob, numWorkers)
 	var wg sync.WaitGroup
+	var failed firstError
 	wg.Add(numWorkers)
 
 	for w := 0; w < numWorkers; w++ {
-		go WriterWorker(ctx, s, jobs, writerdictionary, &wg)
+		go WriterWorker(ctx, s, jobs, dictionary, journal, &failed, &wg)
 	}
 
-	playlistCount := 0
-	lastPlaylistID := ""
-	var currentChunks [][]byte
-	bytesInCurrentPlaylist := 0
-	readBuf := make([]byte, spotify.SpotifyMaxTracksPerRequest)
+	pInfo := playlistInfo(journal.PlaylistVisibility())
 
-	isPublic := true
-	pInfo := spotify.PlaylistInfo{
-		Name:   playlistName,
-		Public: &isPublic,
-	}
+	blockSize := spec.blockSize(dictionary)
 
-	for {
-		n, err := file.Read(readBuf)
-		if n > 0 {
-			chunk := make([]byte, n)
-			copy(chunk, readBuf[:n])
-			currentChunks = append(currentChunks, chunk)
-			bytesInCurrentPlaylist += n
+	var writeErr error
+	lastPlaylistID := ""
+	var lastDescription []byte
+	for sequence := 0; ; sequence++ {
+		block := make([]byte, spec.Channels.capacity()+blockSize)
+		n, err := io.ReadFull(spec.Stream, block)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			writeErr = fmt.Errorf("Error reading file: %w", err)
+			break
+		}
+		if n == 0 {
+			break
 		}
+		description, cover, block := spec.Channels.split(block[:n])
+		var tracks []string
+		if len(block) > 0 {
+			if spec.FEC != nil {
+				if block, err = spec.FEC.encode(block); err != nil {
+					writeErr = err
+					break
+				}
+			}
+			if tracks, err = encodeTracks(block, spec.Width, spec.Encoding, dictionary); err != nil {
+				writeErr = err
+				break
+			}
+		}
+		n = len(tracks)
 
-		if (bytesInCurrentPlaylist >= maxBytesPerPlaylist || err == io.EOF) && len(currentChunks) > 0 {
-			newPlaylistID, createErr := s.CreatePlaylist(ctx, pInfo, lastPlaylistID, playlistCount)
+		playlist, resumed := journal.Playlist(spec.Chain, sequence)
+		if !resumed {
+			pInfo.Name = spec.Name(sequence)
+			pInfo.Description = spec.Description(sequence, "", description)
+			newPlaylistID, createErr := s.CreatePlaylist(ctx, pInfo, "", 0)
 			if createErr != nil {
-				log.Printf("Failed to create playlist %d: %v", playlistCount, createErr)
+				writeErr = fmt.Errorf("Failed to create playlist %d: %w", sequence, createErr)
+				break
+			}
+			if err := journal.AddPlaylist(spec.Chain, newPlaylistID, n, len(block)); err != nil {
+				writeErr = err
 				break
 			}
+			playlist, _ = journal.Playlist(spec.Chain, sequence)
+		}
 
-			jobs <- WriteJob{
-				PlaylistID: newPlaylistID,
-				Chunks:     currentChunks,
+		if !playlist.Linked {
+			if err := s.SetPlaylistDescription(ctx, lastPlaylistID, spec.Description(sequence-1, playlist.ID, lastDescription)); err != nil {
+				writeErr = fmt.Errorf("Failed to link playlist %d: %w", sequence, err)
+				break
+			}
+			if err := journal.SetLinked(spec.Chain, sequence); err != nil {
+				writeErr = err
+				break
 			}
+		}
 
-			lastPlaylistID = newPlaylistID
-			currentChunks = nil
-			bytesInCurrentPlaylist = 0
-			playlistCount++
+		if len(cover) > 0 && !playlist.Cover {
+			image, err := encodeCover(cover)
+			if err == nil {
+				err = s.UploadPlaylistCover(ctx, playlist.ID, image)
+			}
+			if err == nil {
+				err = journal.SetCover(spec.Chain, sequence)
+			}
+			if err != nil {
+				writeErr = fmt.Errorf("Failed to store the cover of playlist %d: %w", sequence, err)
+				break
+			}
 		}
 
-		if err == io.EOF {
+		if resumed && playlist.Length != n {
+			writeErr = fmt.Errorf("Playlist %s was recorded with %d tracks but the file now gives %d", playlist.ID, playlist.Length, n)
 			break
 		}
+
+		done := 0
+		if resumed {
+			details, err := s.GetPlaylistDetails(ctx, playlist.ID)
+			if err != nil {
+				writeErr = err
+				break
+			}
+			done = details.Tracks.Total
+			if done > n {
+				writeErr = fmt.Errorf("Playlist %s holds %d tracks but only %d were expected", playlist.ID, done, n)
+				break
+			}
+			if done != playlist.Tracks {
+				journal.SetTracks(spec.Chain, sequence, done)
+			}
+		}
+
+		if done < n {
+			jobs <- WriteJob{
+				Chain:      spec.Chain,
+				Sequence:   sequence,
+				PlaylistID: playlist.ID,
+				Tracks:     tracks,
+				Done:       done,
+			}
+		}
+		lastPlaylistID = playlist.ID
+		lastDescription = description
 	}
 
 	close(jobs)
 	fmt.Println("All playlist links created. Finishing track uploads...")
 	wg.Wait()
-	fmt.Println("All songs were added to the linked playlists successfully.")
+
+	if writeErr == nil {
+		writeErr = failed.Err()
+	}
+	return writeErr
+}
+
+// encodeTracks returns the tracks holding the payload of a playlist.
+func encodeTracks(block []byte, width int, encoding string, dictionary *crypto.Dictionary) ([]string, error) {
+	if encoding == EncodingPermutation {
+		return encodePermutation(block, dictionary.Entries(width))
+	}
+	symbols := packSymbols(block, width)
+	tracks := make([]string, len(symbols))
+	for i, symbol := range symbols {
+		tracks[i] = dictionary.URI(symbol)
+	}
+	return tracks, nil
 }
 
-func ReaderWorker(ctx context.Context, s *spotify.SpotifyClient, jobs <-chan ReadJob, results chan<- ReadResult, readerdictionary map[string]byte) {
+func ReaderWorker(ctx context.Context, s *spotify.SpotifyClient, jobs <-chan ReadJob, results chan<- ReadResult, dictionary *crypto.Dictionary, width int, fecParams *FECParams, channels Channels, encoding string) {
 	for j := range jobs {
-		playlistURL := fmt.Sprintf(s.WebConfig.PlaylistURL, j.PlaylistID)
-		var allBytes []byte
-		var nextPlaylistID string
+		var data []byte
+		var tracks, damaged int
+		var err error
+		if encoding == EncodingPermutation {
+			data, tracks, err = decodePermutationPlaylist(ctx, s, j.PlaylistID, dictionary, width, j.Bytes)
+		} else {
+			data, tracks, damaged, err = decodePlaylist(ctx, s, j.PlaylistID, dictionary, width, j.Bytes, j.Tracks, fecParams)
+		}
+		if err == nil && channels != 0 {
+			var payload []byte
+			if payload, err = readChannels(ctx, s, j.PlaylistID, channels, len(data)); err == nil {
+				data = append(payload, data...)
+			}
+		}
+		result := ReadResult{
+			Sequence: j.Sequence,
+			Data:     data,
+			Tracks:   tracks,
+			Damaged:  damaged,
+			Err:      err,
+		}
+		results <- result
+	}
+}
 
-		rateLimitMultiplier := 1
+// decodePlaylist reads a playlist of width-bit symbols holding length bytes
+// (ignored for 8-bit symbols) and, for erasure coded uploads, repairs it. It
+// returns the payload, the number of tracks read and the number of shards
+// rebuilt. tracks is the count the index records, -1 when unknown: an erasure
+// coded playlist found empty has lost every shard unless it was written so.
+func decodePlaylist(ctx context.Context, s *spotify.SpotifyClient, playlistID string, dictionary *crypto.Dictionary, width, length, tracks int, fecParams *FECParams) ([]byte, int, int, error) {
+	symbols, erased, unknown, err := readPlaylist(ctx, s, playlistID, dictionary, width)
+	if err != nil {
+		return nil, 0, 0, err
+	}
 
-		for {
-			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, playlistURL, nil)
-			req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
+	var data []byte
+	if width == DefaultSymbolWidth {
+		data = make([]byte, len(symbols))
+		for i, symbol := range symbols {
+			data[i] = byte(symbol)
+		}
+	} else if data, erased, err = unpackSymbols(symbols, erased, width, length); err != nil {
+		return nil, len(symbols), 0, fmt.Errorf("Playlist %s: %w", playlistID, err)
+	}
 
-			query := req.URL.Query()
-			query.Add("fields", "next,items(track(uri))")
-			query.Add("limit", "50")
-			query.Add("market", "US")
-			req.URL.RawQuery = query.Encode()
+	if fecParams == nil || len(symbols) == 0 && tracks == 0 {
+		if unknown != nil {
+			return nil, len(symbols), 0, unknown
+		}
+		return data, len(symbols), 0, nil
+	}
+	if len(symbols) == 0 {
+		return nil, 0, fecParams.shards(), fmt.Errorf("Playlist %s: %w: it holds no tracks, all %d shards are lost", playlistID, fec.ErrTooManyErasures, fecParams.shards())
+	}
 
-			resp, err := s.WebConfig.Client.Do(req)
-			if err != nil {
-				log.Printf("Request Error: %v. Trying Again", err)
-				continue
-			}
+	data, damaged, err := fecParams.decode(data, erased)
+	if err != nil {
+		return nil, len(symbols), damaged, fmt.Errorf("Playlist %s: %w", playlistID, err)
+	}
+	return data, len(symbols), damaged, nil
+}
 
-			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-				if resp.StatusCode == 429 {
-					retryAfterStr := resp.Header.Get("Retry-After")
-					waitTime := spotify.RateLimitWaitTime
+// readPlaylist returns the symbol of every track of a playlist. A relinked
+// track decodes as the track it is linked from. Tracks that are missing or
+// not among the first 1<<width entries of the dictionary read as 0 and are
+// marked in erased; the first of them is also returned as an
+// *ErrUnknownTrack.
+func readPlaylist(ctx context.Context, s *spotify.SpotifyClient, playlistID string, dictionary *crypto.Dictionary, width int) ([]uint16, []bool, *ErrUnknownTrack, error) {
+	tracks, err := readTracks(ctx, s, playlistID, dictionary.Spec.Market)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-					if retryAfterStr != "" {
-						if seconds, err := strconv.Atoi(retryAfterStr); err == nil {
-							waitTime = seconds + 1
-						}
-					}
+	symbols := make([]uint16, len(tracks))
+	erased := make([]bool, len(tracks))
+	var unknown *ErrUnknownTrack
+	for i, track := range tracks {
+		symbol, ok := dictionary.Symbol(track.URI, width)
+		if !ok && track.LinkedFrom != "" {
+			// Spotify relinked the track written here to another one
+			// for the market.
+			symbol, ok = dictionary.Symbol(track.LinkedFrom, width)
+		}
+		if !ok && unknown == nil {
+			unknown = &ErrUnknownTrack{PlaylistID: playlistID, Position: i, URI: track.URI}
+		}
+		symbols[i] = symbol
+		erased[i] = !ok
+	}
+	return symbols, erased, unknown, nil
+}
 
-					jitter := mathRand.IntN(1000)
-					log.Printf("[Worker] Rate limit (429). Waiting %d seconds + %d ms of jitter...", waitTime, jitter)
+// playlistTrack is a track of a playlist as read in a market, with the track
+// it is linked from when Spotify relinked it.
+type playlistTrack struct {
+	URI        string
+	LinkedFrom string
+}
 
-					time.Sleep(time.Duration(waitTime)*time.Second + time.Duration(jitter)*time.Millisecond)
+func readTracks(ctx context.Context, s *spotify.SpotifyClient, playlistID, market string) ([]playlistTrack, error) {
+	var tracks []playlistTrack
+	next := ""
+	for {
+		items, err := s.GetPlaylistTracks(ctx, playlistID, market, next)
+		if err != nil {
+			return nil, &ErrPlaylistFetch{PlaylistID: playlistID, Err: err}
+		}
 
-					continue
+		for _, item := range items.Items {
+			track := playlistTrack{URI: item.Track.Uri}
+			if item.Track.LinkedFrom != nil {
+				track.LinkedFrom = item.Track.LinkedFrom.URI
+			}
+			tracks = append(tracks, track)
+		}
 
-				}
+		if items.Next == "" {
+			return tracks, nil
+		}
+		next = items.Next
+	}
+}
 
-				if resp.StatusCode == 502 {
-					log.Printf("[Worker] Error 502 in playlist %s. Trying again in 1s...", j.PlaylistID)
-					time.Sleep(1 * time.Second)
-					rateLimitMultiplier++
-					resp.Body.Close()
-					continue
-				}
+// decodePermutationPlaylist reads the length bytes a playlist holds in the
+// order of its tracks, and returns them with the number of tracks read. A
+// track that is not a dictionary entry would shift the ranks of the others,
+// so it fails the playlist as an *ErrUnknownTrack.
+func decodePermutationPlaylist(ctx context.Context, s *spotify.SpotifyClient, playlistID string, dictionary *crypto.Dictionary, width, length int) ([]byte, int, error) {
+	tracks, err := readTracks(ctx, s, playlistID, dictionary.Spec.Market)
+	if err != nil {
+		return nil, 0, err
+	}
+	uris := make([]string, len(tracks))
+	for i, track := range tracks {
+		uris[i] = track.URI
+		if track.LinkedFrom != "" {
+			uris[i] = track.LinkedFrom
+		}
+		if _, ok := dictionary.Symbol(uris[i], width); !ok {
+			return nil, len(tracks), &ErrUnknownTrack{PlaylistID: playlistID, Position: i, URI: track.URI}
+		}
+	}
+	data, err := decodePermutation(uris, length)
+	if err != nil {
+		return nil, len(tracks), fmt.Errorf("Playlist %s: %w", playlistID, err)
+	}
+	return data, len(tracks), nil
+}
 
-				log.Printf("Fatal error %d playlist %s", resp.StatusCode, j.PlaylistID)
-				resp.Body.Close()
-				break
-			}
+type ReadOptions struct {
+	// VerifyOnly checks the chain against its manifest without keeping
+	// anything on disk.
+	VerifyOnly bool
+	// Decoder is a decoder file to load the dictionary from instead of
+	// generating it, "" for none.
+	Decoder string
+	// PartDir keeps the playlists read so far in a directory so that an
+	// interrupted download can be resumed. Without it they are written out
+	// in order as they are read.
+	PartDir string
+	// DecoderPassword opens the decoder file when it was rekeyed to a
+	// password other than the upload's.
+	DecoderPassword string
+	// DictionaryCache is as in WriteOptions.
+	DictionaryCache string
+}
 
-			var items spotify.PlaylistItems
-			json.NewDecoder(resp.Body).Decode(&items)
-			resp.Body.Close()
+// dispatchReads queues the playlists still missing from progress, walking the
+// rest of the chain as needed, and closes jobs when done.
+func dispatchReads(ctx context.Context, s *spotify.SpotifyClient, startPlaylistID string, progress *downloadProgress, jobs chan<- ReadJob) error {
+	defer close(jobs)
 
-			for _, item := range items.Items {
-				if b, ok := readerdictionary[item.Track.Uri]; ok {
-					allBytes = append(allBytes, b)
-				} else {
-					log.Fatal("Stopping execution to avoid saving a corrupted file.")
-				}
-			}
+	send := func(j ReadJob) error {
+		select {
+		case jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
-			if items.Next == "" {
-				nextID, _ := s.GetNextPlaylist(ctx, j.PlaylistID)
-				nextPlaylistID = nextID
-				break
-			}
-			playlistURL = items.Next
+	for _, j := range progress.pending() {
+		if err := send(j); err != nil {
+			return err
 		}
+	}
 
-		results <- ReadResult{
-			Sequence: j.Sequence,
-			Data:     allBytes,
-			NextID:   nextPlaylistID,
+	currentPlaylistID, chainComplete := progress.last()
+	if chainComplete {
+		return nil
+	}
+	if currentPlaylistID == "" {
+		currentPlaylistID = startPlaylistID
+		sequence, err := progress.addPlaylist(currentPlaylistID)
+		if err != nil {
+			return err
+		}
+		if err := send(ReadJob{Sequence: sequence, PlaylistID: currentPlaylistID, Tracks: -1}); err != nil {
+			return err
 		}
 	}
+
+	for {
+		nextPlaylistID, err := s.GetNextPlaylist(ctx, currentPlaylistID)
+		if errors.Is(err, spotify.ErrNoMorePlaylist) {
+			return progress.setChainComplete()
+		}
+		if err != nil {
+			return fmt.Errorf("Error while getting next playlist: %w", err)
+		}
+
+		sequence, err := progress.addPlaylist(nextPlaylistID)
+		if err != nil {
+			return err
+		}
+		if err := send(ReadJob{Sequence: sequence, PlaylistID: nextPlaylistID, Tracks: -1}); err != nil {
+			return err
+		}
+		currentPlaylistID = nextPlaylistID
+	}
+}
+
+// readHead returns the description of startPlaylistID when it is the head
+// of an index. Uploads from before indexes existed are left to dispatchReads,
+// which walks their chain one description at a time.
+func readHead(ctx context.Context, s *spotify.SpotifyClient, startPlaylistID string) (IndexDescription, bool, error) {
+	details, err := s.GetPlaylistDetails(ctx, startPlaylistID)
+	if err != nil {
+		return IndexDescription{}, false, &ErrPlaylistFetch{PlaylistID: startPlaylistID, Err: err}
+	}
+	head, ok := ParseIndexDescription(details.Description)
+	return head, ok, nil
 }
 
-func Reader(startPlaylistID, filename, password, decoder string, s *spotify.SpotifyClient) {
-	ctx := context.Background()
-	var readerdictionary map[string]byte
-	var err error
+// checkDictionary makes sure a loaded dictionary can stand in for the one
+// opts describes.
+func checkDictionary(dictionary *crypto.Dictionary, opts crypto.DictionaryOptions) error {
+	if dictionary.Spec != opts.Spec {
+		return fmt.Errorf("it was searched for with %s, the upload uses %s", dictionary.Spec, opts.Spec)
+	}
+	if dictionary.Width < opts.Width {
+		return fmt.Errorf("it holds %d-bit symbols, the upload uses %d-bit symbols", dictionary.Width, opts.Width)
+	}
+	return nil
+}
 
+// loadReaderDictionary generates the dictionary opts describes, or loads it
+// from decoder.
+func loadReaderDictionary(ctx context.Context, s *spotify.SpotifyClient, password, decoder, decoderPassword string, opts crypto.DictionaryOptions) (*crypto.Dictionary, error) {
 	if decoder == "" {
-		_, readerdictionary, err = crypto.NewDictionary(ctx, password, s)
-	} else {
-		readerdictionary, err = crypto.LoadMap(decoder, password)
+		dictionary, err := crypto.NewDictionary(ctx, password, s, opts)
+		if err != nil {
+			return nil, fmt.Errorf("Error initializing dictionary: %w", err)
+		}
+		return dictionary, nil
 	}
+
+	if decoderPassword == "" {
+		decoderPassword = password
+	}
+	dictionary, err := crypto.LoadDictionary(decoder, decoderPassword)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing dictionary: %w", err)
+	}
+	if err := checkDictionary(dictionary, opts); err != nil {
+		return nil, fmt.Errorf("Cannot use decoder map %s: %w", decoder, err)
+	}
+	return dictionary, nil
+}
+
+// Reader restores the upload starting at startPlaylistID to filename, or to
+// the name its manifest records when filename is "". Playlists read are kept
+// in PartDir until the file is complete, so that an interrupted download can
+// be resumed.
+func Reader(startPlaylistID, filename, password, decoder string, s *spotify.SpotifyClient, opts ReadOptions) error {
+	opts.Decoder = decoder
+	if !opts.VerifyOnly {
+		opts.PartDir = PartDir(filename, startPlaylistID)
+	}
+	out := &fileOutput{Path: filename, discard: opts.VerifyOnly}
+	manifest, err := read(context.Background(), s, startPlaylistID, password, opts, out.open)
+	if err != nil {
+		out.Abort()
+		return err
+	}
+	if err := out.Commit(manifest); err != nil {
+		return err
+	}
+
+	switch {
+	case manifest == nil:
+	case opts.VerifyOnly:
+		fmt.Printf("Verified %s (%d bytes, SHA-256 %s)\n", manifest.Name, manifest.Size, manifest.SHA256)
+	default:
+		fmt.Printf("Restored %s (%d bytes, SHA-256 verified) to %s\n", manifest.Name, manifest.Size, out.Path)
+	}
+	return nil
+}
+
+// Get writes the contents of the upload starting at startPlaylistID to w and
+// returns its manifest, nil for uploads from before manifests existed. Unless
+// opts.PartDir is set, playlists are written as soon as those before them
+// are, so w receives data before the whole upload is checked: an error means
+// what was written must not be used.
+func Get(ctx context.Context, s *spotify.SpotifyClient, startPlaylistID string, w io.Writer, password string, opts ReadOptions) (*Manifest, error) {
+	return read(ctx, s, startPlaylistID, password, opts, func(*Manifest) (io.Writer, error) {
+		return w, nil
+	})
+}
+
+// read downloads the upload starting at startPlaylistID into the writer open
+// returns once the manifest is known.
+func read(ctx context.Context, s *spotify.SpotifyClient, startPlaylistID, password string, opts ReadOptions, open func(m *Manifest) (io.Writer, error)) (*Manifest, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dir := opts.PartDir
+	progress, err := openProgress(dir, startPlaylistID)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	kept := func(err error) error {
+		if dir == "" {
+			return err
+		}
+		return fmt.Errorf("%w (playlists read so far are kept in %s)", err, dir)
+	}
+
+	// The symbol width and dictionary spec are needed to build the
+	// dictionary, so the head is looked at first. A resumed download
+	// already knows them. Uploads without an index predate both.
+	var head IndexDescription
+	isIndex := false
+	if progress.empty() {
+		if head, isIndex, err = readHead(ctx, s, startPlaylistID); err != nil {
+			return nil, err
+		}
+	}
+	width, spec := progress.Width, progress.Dictionary
+	if isIndex {
+		width, spec = head.Width, head.Dictionary
+	}
+	if width == 0 {
+		width = DefaultSymbolWidth
+	}
+	if err := validWidth(width); err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		sequential := crypto.SequentialDictionarySpec()
+		spec = &sequential
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	encoding := progress.Encoding
+	if isIndex {
+		if err := head.Channels.validate(); err != nil {
+			return nil, err
+		}
+		encoding = head.Encoding
+	}
+	if err := validEncoding(encoding); err != nil {
+		return nil, err
+	}
+	dictionaryOpts := crypto.DictionaryOptions{Width: width, Spec: *spec, CacheDir: opts.DictionaryCache}
+	dictionary, err := loadReaderDictionary(ctx, s, password, opts.Decoder, opts.DecoderPassword, dictionaryOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if isIndex {
+		index, err := readIndex(ctx, s, startPlaylistID, head, dictionary)
+		if err != nil {
+			return nil, kept(err)
+		}
+		fmt.Printf("Index lists %d playlist(s), reading them in parallel\n", len(index.Playlists))
+		if err := progress.setIndex(index, head); err != nil {
+			return nil, kept(err)
+		}
 	}
 
 	jobs := make(chan ReadJob, numWorkers)
 	results := make(chan ReadResult, numWorkers)
 
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
 	for w := 0; w < numWorkers; w++ {
-		go ReaderWorker(ctx, s, jobs, results, readerdictionary)
+		go func() {
+			defer wg.Done()
+			ReaderWorker(ctx, s, jobs, results, dictionary, width, progress.FEC, progress.Channels, progress.Encoding)
+		}()
 	}
 
-	f, _ := os.OpenFile(filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	defer f.Close()
+	var dispatchErr error
+	go func() {
+		dispatchErr = dispatchReads(ctx, s, startPlaylistID, progress, jobs)
+		wg.Wait()
+		close(results)
+	}()
 
-	pendingResults := make(map[int]ReadResult)
-	nextToWrite := 0
-	currentPlaylistID := startPlaylistID
-	jobsSent := 0
-
-	doneSending := false
+	out := newRestoreWriter(password, open)
+	// Only uploads from before indexes existed may be unencrypted.
+	out.encrypted = progress.Indexed
+	var ordered *orderedWriter
+	if dir == "" {
+		ordered = newOrderedWriter(out)
+	}
 
-	for {
-		if !doneSending && len(jobs) < numWorkers && currentPlaylistID != "" {
-			jobs <- ReadJob{Sequence: jobsSent, PlaylistID: currentPlaylistID}
-
-			currentPlaylistID, err = s.GetNextPlaylist(ctx, currentPlaylistID)
-			jobsSent++
-			if currentPlaylistID == "" && errors.Is(err, spotify.ErrNoMorePlaylist) {
-				doneSending = true
-			} else if err != nil {
-				fmt.Printf("Error while getting next playlist: %v\n", err)
-				return
+	var readErr error
+	damaged, repairedPlaylists, worst := 0, 0, 0
+	for res := range results {
+		if readErr != nil {
+			continue
+		}
+		if res.Err != nil {
+			readErr = res.Err
+			cancel()
+			continue
+		}
+		if err := progress.check(res.Sequence, res.Tracks); err != nil {
+			readErr = err
+			cancel()
+			continue
+		}
+		if res.Damaged > 0 {
+			fmt.Printf("Playlist sequence %d: rebuilt %d damaged shard(s) from parity.\n", res.Sequence, res.Damaged)
+			damaged += res.Damaged
+			repairedPlaylists++
+			worst = max(worst, res.Damaged)
+		}
+		if err := progress.complete(res.Sequence, res.Data); err != nil {
+			readErr = err
+			cancel()
+			continue
+		}
+		if ordered != nil {
+			if err := ordered.add(res.Sequence, res.Data); err != nil {
+				readErr = err
+				cancel()
+				continue
 			}
 		}
+		fmt.Printf("Playlist sequence %d saved.\n", res.Sequence)
+	}
+	if readErr == nil {
+		readErr = dispatchErr
+	}
+	if readErr != nil {
+		return nil, kept(readErr)
+	}
+	if !progress.done() {
+		return nil, kept(errors.New("Download incomplete"))
+	}
 
-		select {
-		case res := <-results:
-			pendingResults[res.Sequence] = res
-			for {
-				if nextRes, ok := pendingResults[nextToWrite]; ok {
-					f.Write(nextRes.Data)
-					fmt.Printf("Playlist sequence %d written to the file.\n", nextToWrite)
-					delete(pendingResults, nextToWrite)
-					nextToWrite++
-
-					if doneSending && nextToWrite == jobsSent {
-						fmt.Println("Completed!")
-						return
-					}
-				} else {
-					break
-				}
-			}
-		case <-time.After(time.Second * 10):
-			if doneSending && nextToWrite == jobsSent {
-				return
-			}
+	if ordered == nil {
+		if err := progress.assemble(out); err != nil {
+			return nil, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		if errors.Is(err, ErrSizeMismatch) || errors.Is(err, ErrChecksumMismatch) {
+			progress.remove()
 		}
+		return nil, err
+	}
+	progress.remove()
+
+	fmt.Println("Completed!")
+	if progress.FEC != nil {
+		fmt.Printf("Erasure coding %s: %d shard(s) rebuilt in %d playlist(s), at most %d of %d parity shards used in one playlist\n",
+			progress.FEC, damaged, repairedPlaylists, worst, progress.FEC.ParityShards)
 	}
+	return out.Manifest, nil
 }
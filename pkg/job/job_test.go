@@ -0,0 +1,421 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"spotifyfs/pkg/crypto"
+	"spotifyfs/pkg/fec"
+	"spotifyfs/pkg/spotify"
+	"spotifyfs/pkg/spotify/spotifytest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse"
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func testManifest(name string, data []byte) Manifest {
+	sum := sha256.Sum256(data)
+	return Manifest{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// put uploads data under name, failing the test on error.
+func put(t *testing.T, s *spotify.SpotifyClient, name string, data []byte, opts WriteOptions) string {
+	t.Helper()
+	id, err := Put(context.Background(), s, bytes.NewReader(data), testManifest(name, data), testPassword, name, opts)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	return id
+}
+
+func get(s *spotify.SpotifyClient, id string, opts ReadOptions) ([]byte, error) {
+	var out bytes.Buffer
+	_, err := Get(context.Background(), s, id, &out, testPassword, opts)
+	return out.Bytes(), err
+}
+
+// dataPlaylists returns the data playlists of the upload named name, in order.
+func dataPlaylists(srv *spotifytest.Server, name string) []spotifytest.Playlist {
+	byName := make(map[string]spotifytest.Playlist)
+	for _, p := range srv.Playlists() {
+		byName[p.Name] = p
+	}
+	var playlists []spotifytest.Playlist
+	for {
+		p, ok := byName[fmt.Sprintf("%s%d", name, len(playlists)+1)]
+		if !ok {
+			return playlists
+		}
+		playlists = append(playlists, p)
+	}
+}
+
+// checkPrivate fails the test unless only the owner can read path.
+func checkPrivate(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("%s has mode %v, want 0600", path, perm)
+	}
+}
+
+func TestPutGetRoundTrip(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+
+	tests := []struct {
+		name string
+		data []byte
+		opts WriteOptions
+	}{
+		{"empty", nil, WriteOptions{}},
+		{"small", []byte("hello"), WriteOptions{}},
+		{"chained", testData(25000), WriteOptions{Compression: CompressionNone}},
+		{"compressed", bytes.Repeat([]byte("spotifyfs "), 5000), WriteOptions{}},
+		{"wide", testData(20000), WriteOptions{SymbolWidth: 12}},
+		{"parity", testData(20000), WriteOptions{ParityShards: 4}},
+		{"channels", testData(20000), WriteOptions{Channels: ChannelDescription | ChannelCover}},
+		{"permutation", testData(20000), WriteOptions{Encoding: EncodingPermutation}},
+		{"permutation wide", testData(20000), WriteOptions{Encoding: EncodingPermutation, SymbolWidth: 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := put(t, client, tt.name, tt.data, tt.opts)
+			got, err := get(client, id, ReadOptions{})
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Fatalf("Get returned %d bytes that differ from the %d uploaded", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestPutResumesAfterForbidden(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	data := testData(25000)
+	opts := WriteOptions{Compression: CompressionNone, Journal: filepath.Join(t.TempDir(), "journal.json")}
+
+	srv.Inject(spotifytest.Fault{Method: http.MethodPost, Path: "/v1/playlists/", Status: http.StatusForbidden, Times: 1})
+	_, err := Put(context.Background(), client, bytes.NewReader(data), testManifest("resume", data), testPassword, "resume", opts)
+	var apiErr *spotify.APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusForbidden {
+		t.Fatalf("Put returned %v, want the injected 403", err)
+	}
+	created := len(srv.Playlists())
+
+	opts.Resume = true
+	id := put(t, client, "resume", data, opts)
+	got, err := get(client, id, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Resumed upload does not read back")
+	}
+
+	journal, err := LoadJournal(opts.Journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !journal.Complete {
+		t.Error("Journal not marked complete")
+	}
+	checkPrivate(t, opts.Journal)
+	// The data playlists created before the fault are reused, only the
+	// rest and the index are new.
+	if want := len(journal.Playlists) + len(journal.Index); len(srv.Playlists()) != want {
+		t.Errorf("%d playlists exist after resuming, want %d (%d before)", len(srv.Playlists()), want, created)
+	}
+}
+
+func TestPutWithoutJournalCannotResume(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+
+	_, err := Put(context.Background(), srv.NewClient(), bytes.NewReader(nil), Manifest{}, testPassword, "x", WriteOptions{Resume: true})
+	if err == nil {
+		t.Fatal("Resuming without a journal succeeded")
+	}
+}
+
+func TestGetResumesFromPartDir(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	data := testData(40000)
+	id := put(t, client, "parts", data, WriteOptions{Compression: CompressionNone})
+	playlists := dataPlaylists(srv, "parts")
+	if len(playlists) < 4 {
+		t.Fatalf("Upload has %d data playlists, want at least 4", len(playlists))
+	}
+
+	dir := filepath.Join(t.TempDir(), "parts")
+	last := playlists[len(playlists)-1]
+	srv.Inject(spotifytest.Fault{Method: http.MethodGet, Path: "/v1/playlists/" + last.ID + "/tracks", Status: http.StatusNotFound, Times: 1})
+	if _, err := get(client, id, ReadOptions{PartDir: dir}); err == nil {
+		t.Fatal("Get succeeded with a playlist missing")
+	}
+
+	progress, err := openProgress(dir, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPrivate(t, filepath.Join(dir, progressFile))
+	read := progress.count()
+	if read == 0 || read == len(playlists) {
+		t.Fatalf("%d of %d playlists kept after the failure", read, len(playlists))
+	}
+	// Playlists already read must not be fetched again.
+	for sequence, done := range progress.Completed {
+		if done {
+			srv.Inject(spotifytest.Fault{Method: http.MethodGet, Path: "/v1/playlists/" + progress.Playlists[sequence] + "/tracks", Status: http.StatusNotFound})
+		}
+	}
+
+	got, err := get(client, id, ReadOptions{PartDir: dir})
+	if err != nil {
+		t.Fatalf("Resumed Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Resumed download differs")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Part directory left behind: %v", err)
+	}
+}
+
+func TestRetryAfterIsHonoured(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+
+	srv.Inject(spotifytest.Fault{Method: http.MethodPost, Path: "/v1/users/", Status: http.StatusTooManyRequests, RetryAfter: 1, Times: 1})
+	start := time.Now()
+	id := put(t, client, "limited", []byte("rate limited"), WriteOptions{})
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Upload took %s, Retry-After asked for 1s", elapsed)
+	}
+	if got, err := get(client, id, ReadOptions{}); err != nil || string(got) != "rate limited" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+}
+
+func TestTransientFaultsAreRetried(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	data := testData(5000)
+	id := put(t, client, "flaky", data, WriteOptions{})
+
+	srv.Inject(spotifytest.Fault{Method: http.MethodGet, Path: "/v1/playlists/", Status: http.StatusBadGateway, Times: 2})
+	srv.Inject(spotifytest.Fault{Method: http.MethodGet, Path: "/v1/playlists/", Malformed: true, Times: 2})
+	got, err := get(client, id, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data differs after retries")
+	}
+}
+
+func TestInjectRejectsEmptyFault(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	defer func() {
+		if recover() == nil {
+			t.Error("Inject accepted a fault with neither Status nor Malformed")
+		}
+	}()
+	srv.Inject(spotifytest.Fault{})
+}
+
+func TestFECRepairsRemovedTracks(t *testing.T) {
+	const dataShards, parityShards = 4, 2
+	tests := []struct {
+		name    string
+		damaged int
+		wantErr bool
+	}{
+		{"none", 0, false},
+		{"one", 1, false},
+		{"all parity", parityShards, false},
+		{"one past parity", parityShards + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := spotifytest.NewServer()
+			defer srv.Close()
+			client := srv.NewClient()
+			data := testData(3000)
+			id := put(t, client, "fec", data, WriteOptions{Compression: CompressionNone, DataShards: dataShards, ParityShards: parityShards})
+
+			// One removed track in each of the first shards.
+			p := dataPlaylists(srv, "fec")[0]
+			stride := len(p.Tracks) / (dataShards + parityShards)
+			for shard := 0; shard < tt.damaged; shard++ {
+				srv.SetTrack(p.ID, shard*stride+1, "spotify:track:removedfromthecatalog")
+			}
+
+			got, err := get(client, id, ReadOptions{})
+			if tt.wantErr {
+				if !errors.Is(err, fec.ErrTooManyErasures) {
+					t.Fatalf("Get returned %v, want ErrTooManyErasures", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("Repaired data differs")
+			}
+		})
+	}
+}
+
+func TestRelinkedTracksDecode(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	data := testData(2000)
+	id := put(t, client, "relinked", data, WriteOptions{Compression: CompressionNone})
+
+	p := dataPlaylists(srv, "relinked")[0]
+	srv.RelinkTrack(p.Tracks[0], "spotify:track:relinkedelsewhere")
+	got, err := get(client, id, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data differs with a relinked track")
+	}
+}
+
+func TestAmbiguousAddIsNotRepeated(t *testing.T) {
+	tests := []struct {
+		name  string
+		after bool
+	}{
+		{"applied", true},
+		{"not applied", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := spotifytest.NewServer()
+			defer srv.Close()
+			client := srv.NewClient()
+			data := testData(5000)
+
+			srv.Inject(spotifytest.Fault{Method: http.MethodPost, Path: "/v1/playlists/", Status: http.StatusBadGateway, After: tt.after, Times: 1})
+			id := put(t, client, "ambiguous", data, WriteOptions{Compression: CompressionNone})
+			// The index records the track count of every data playlist,
+			// so a batch added twice fails the read.
+			got, err := get(client, id, ReadOptions{})
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("Data differs")
+			}
+		})
+	}
+}
+
+func TestSwappedTracksAreRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		first int
+	}{
+		// The first tracks hold the manifest magic.
+		{"header", 0},
+		{"payload", 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := spotifytest.NewServer()
+			defer srv.Close()
+			client := srv.NewClient()
+			id := put(t, client, "swapped", testData(3000), WriteOptions{})
+
+			p := dataPlaylists(srv, "swapped")[0]
+			second := tt.first + 1
+			for p.Tracks[second] == p.Tracks[tt.first] {
+				second++
+			}
+			srv.SetTrack(p.ID, tt.first, p.Tracks[second])
+			srv.SetTrack(p.ID, second, p.Tracks[tt.first])
+
+			_, err := get(client, id, ReadOptions{})
+			if !errors.Is(err, ErrCorrupt) && !errors.Is(err, crypto.ErrAuthentication) {
+				t.Fatalf("Get returned %v, want ErrCorrupt or ErrAuthentication", err)
+			}
+		})
+	}
+}
+
+func TestEmptiedPlaylistIsNamed(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    WriteOptions
+		wantErr error
+	}{
+		{"plain", WriteOptions{Compression: CompressionNone}, ErrIndexMismatch},
+		{"parity", WriteOptions{Compression: CompressionNone, ParityShards: 4}, fec.ErrTooManyErasures},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := spotifytest.NewServer()
+			defer srv.Close()
+			client := srv.NewClient()
+			id := put(t, client, "emptied", testData(25000), tt.opts)
+
+			p := dataPlaylists(srv, "emptied")[1]
+			srv.ClearTracks(p.ID)
+			_, err := get(client, id, ReadOptions{})
+			if !errors.Is(err, tt.wantErr) || !strings.Contains(err.Error(), p.ID) {
+				t.Fatalf("Get returned %v, want %v naming %s", err, tt.wantErr, p.ID)
+			}
+		})
+	}
+}
+
+func TestChannelOnlyPlaylistWithParity(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	data := testData(200)
+	id := put(t, client, "tiny", data, WriteOptions{Compression: CompressionNone, ParityShards: 4, Channels: ChannelDescription | ChannelCover})
+	if p := dataPlaylists(srv, "tiny")[0]; len(p.Tracks) != 0 {
+		t.Fatalf("The data playlist holds %d tracks, want none", len(p.Tracks))
+	}
+	got, err := get(client, id, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Get returned other data")
+	}
+}
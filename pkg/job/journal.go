@@ -0,0 +1,294 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"spotifyfs/pkg/crypto"
+	"sync"
+	"time"
+)
+
+var ErrUnfinishedUpload = errors.New("An unfinished upload exists for this name, resume it or delete its journal")
+
+// Journal records the progress of an upload on disk so that an interrupted
+// Writer can pick up where it stopped. It is rewritten after every playlist
+// created or linked and after every batch of tracks added. A journal without
+// a path is only kept in memory.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+
+	File      string             `json:"file"`
+	Name      string             `json:"name"`
+	Manifest  Manifest           `json:"manifest"`
+	Playlists []*JournalPlaylist `json:"playlists"`
+	Index     []*JournalPlaylist `json:"index,omitempty"`
+	Complete  bool               `json:"complete"`
+
+	// Encryption holds the salt and nonce of the upload so that a resumed
+	// run encrypts to the same bytes, KeyCheck makes sure it also uses the
+	// same password.
+	Encryption *crypto.StreamParams `json:"encryption,omitempty"`
+	KeyCheck   string               `json:"key_check,omitempty"`
+	// Compression is the mode chosen when the upload started, so that a
+	// resumed run does not decide differently.
+	Compression string `json:"compression,omitempty"`
+	// FEC is the erasure code of the upload, nil when it has none.
+	FEC *FECParams `json:"fec,omitempty"`
+	// Width is the symbol width of the data playlists, 0 for journals
+	// written before it could be chosen (8 bits). DictionarySpec is how the
+	// dictionary is searched for; journals written before it existed hold
+	// the dictionary version in Dictionary instead.
+	Width          int                    `json:"width,omitempty"`
+	Dictionary     int                    `json:"dictionary,omitempty"`
+	DictionarySpec *crypto.DictionarySpec `json:"dictionary_spec,omitempty"`
+	// Channels is the metadata that carries payload in data playlists and
+	// Encoding how their tracks do.
+	Channels Channels `json:"channels,omitempty"`
+	Encoding string   `json:"encoding,omitempty"`
+	// Created is when the upload started, zero for journals written before
+	// it was recorded.
+	Created time.Time `json:"created"`
+	// Visibility is the one playlists are created with, "" for journals
+	// written before it could be chosen (public).
+	Visibility string `json:"visibility,omitempty"`
+}
+
+// Chain selects which of the upload's playlist chains a journal call is about.
+type Chain int
+
+const (
+	DataChain Chain = iota
+	IndexChain
+)
+
+type JournalPlaylist struct {
+	ID string `json:"id"`
+	// Linked is set once the previous playlist's description points here.
+	Linked bool `json:"linked"`
+	// Length is the number of tracks the playlist must hold, Tracks the
+	// number confirmed added so far.
+	Length int `json:"length"`
+	Tracks int `json:"tracks"`
+	// Bytes is the payload length of the playlist's tracks.
+	Bytes int `json:"bytes,omitempty"`
+	// Cover is set once the cover carrying payload is uploaded.
+	Cover bool `json:"cover,omitempty"`
+}
+
+func JournalPath(playlistName string) string {
+	return playlistName + "_Journal.json"
+}
+
+func NewJournal(path, file, name string, manifest Manifest) *Journal {
+	return &Journal{
+		path:     path,
+		File:     file,
+		Name:     name,
+		Manifest: manifest,
+		Created:  time.Now(),
+	}
+}
+
+func LoadJournal(path string) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("Error reading journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// save must be called with j.mu held.
+func (j *Journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Only the owner may read it: it holds the salt and nonce of the
+	// upload and the key check.
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Error writing journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("Error writing journal: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.save()
+}
+
+// chain must be called with j.mu held.
+func (j *Journal) chain(c Chain) *[]*JournalPlaylist {
+	if c == IndexChain {
+		return &j.Index
+	}
+	return &j.Playlists
+}
+
+func (j *Journal) Playlist(c Chain, sequence int) (JournalPlaylist, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	playlists := *j.chain(c)
+	if sequence >= len(playlists) {
+		return JournalPlaylist{}, false
+	}
+	return *playlists[sequence], true
+}
+
+func (j *Journal) PlaylistIDs(c Chain) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	playlists := *j.chain(c)
+	ids := make([]string, len(playlists))
+	for i, p := range playlists {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+// Handle is the ID a reader starts from: the index head, or the first data
+// playlist for uploads journaled before indexes existed.
+func (j *Journal) Handle() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Index) > 0 {
+		return j.Index[0].ID
+	}
+	if len(j.Playlists) > 0 {
+		return j.Playlists[0].ID
+	}
+	return ""
+}
+
+func (j *Journal) AddPlaylist(c Chain, id string, length, bytes int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	playlists := j.chain(c)
+	*playlists = append(*playlists, &JournalPlaylist{
+		ID:     id,
+		Linked: len(*playlists) == 0,
+		Length: length,
+		Bytes:  bytes,
+	})
+	return j.save()
+}
+
+func (j *Journal) SetLinked(c Chain, sequence int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	(*j.chain(c))[sequence].Linked = true
+	return j.save()
+}
+
+func (j *Journal) SetTracks(c Chain, sequence, tracks int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	(*j.chain(c))[sequence].Tracks = tracks
+	return j.save()
+}
+
+func (j *Journal) SetCover(c Chain, sequence int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	(*j.chain(c))[sequence].Cover = true
+	return j.save()
+}
+
+func (j *Journal) SetEncryption(params crypto.StreamParams, keyCheck string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Encryption = &params
+	j.KeyCheck = keyCheck
+	return j.save()
+}
+
+func (j *Journal) SetCompression(compression string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Compression = compression
+	return j.save()
+}
+
+func (j *Journal) SetFEC(fecParams *FECParams) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.FEC = fecParams
+	return j.save()
+}
+
+func (j *Journal) SetChannels(channels Channels) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Channels = channels
+	return j.save()
+}
+
+func (j *Journal) SetEncoding(encoding string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Encoding = encoding
+	return j.save()
+}
+
+func (j *Journal) SetVisibility(visibility string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Visibility = visibility
+	return j.save()
+}
+
+// PlaylistVisibility is the visibility the playlists of the upload are
+// created with.
+func (j *Journal) PlaylistVisibility() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Visibility == "" {
+		return VisibilityPublic
+	}
+	return j.Visibility
+}
+
+func (j *Journal) SetDictionary(width int, spec crypto.DictionarySpec) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Width = width
+	j.DictionarySpec = &spec
+	return j.save()
+}
+
+// DictionaryOptions describes the dictionary the upload is written with.
+func (j *Journal) DictionaryOptions() (crypto.DictionaryOptions, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	opts := crypto.DictionaryOptions{Width: max(j.Width, DefaultSymbolWidth)}
+	if j.DictionarySpec != nil {
+		opts.Spec = *j.DictionarySpec
+		return opts, nil
+	}
+	var err error
+	opts.Spec, err = crypto.DictionarySpecVersion(j.Dictionary)
+	return opts, err
+}
+
+func (j *Journal) SetComplete() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Complete = true
+	return j.save()
+}
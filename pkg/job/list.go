@@ -0,0 +1,51 @@
+package job
+
+import (
+	"context"
+	"spotifyfs/pkg/spotify"
+	"time"
+)
+
+// Upload is a file stored in the account, as found by List. Size, Playlists
+// and Created are zero for uploads made before the index head recorded them.
+type Upload struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size,omitempty"`
+	Playlists  int       `json:"playlists,omitempty"`
+	Created    time.Time `json:"created,omitzero"`
+	Visibility string    `json:"visibility"`
+}
+
+// List returns the uploads the current user owns, found by their index heads.
+// Uploads made before indexes existed are left out.
+func List(ctx context.Context, s *spotify.SpotifyClient) ([]Upload, error) {
+	var uploads []Upload
+	next := ""
+	for {
+		page, err := s.GetMyPlaylists(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range page.Items {
+			d, ok := ParseIndexDescription(p.Description)
+			if !ok || d.Part != 0 || p.Owner.ID != s.ClientID {
+				continue
+			}
+			uploads = append(uploads, Upload{
+				ID:         p.ID,
+				Name:       p.Name,
+				Size:       d.Size,
+				Playlists:  d.Playlists,
+				Created:    d.Created,
+				Visibility: VisibilityOf(p),
+			})
+		}
+
+		if page.Next == "" {
+			return uploads, nil
+		}
+		next = page.Next
+	}
+}
@@ -0,0 +1,346 @@
+package job
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"spotifyfs/pkg/crypto"
+	"time"
+)
+
+const (
+	ManifestMagic = "SPFS"
+	// Version 2 headers may describe a layer (encryption, compression)
+	// whose contents are another stream starting with its own header.
+	ManifestVersion = 2
+
+	// magic, version byte and the big endian uint32 length of the JSON body.
+	manifestPrefixSize = len(ManifestMagic) + 1 + 4
+	maxManifestSize    = 64 * 1024
+)
+
+var (
+	ErrNoManifest       = errors.New("Upload has no manifest, an output file name is required")
+	ErrManifestVersion  = errors.New("Unsupported manifest version")
+	ErrSizeMismatch     = errors.New("Restored file size does not match the manifest")
+	ErrChecksumMismatch = errors.New("Restored file SHA-256 does not match the manifest")
+	// ErrCorrupt is returned for an indexed upload whose payload does not
+	// start with an encrypted stream, as every indexed upload does.
+	ErrCorrupt = errors.New("Upload payload is not encrypted: the playlists were altered")
+)
+
+// Manifest describes the uploaded file. It is written in front of the file
+// contents so that the reader can restore and check them. A header with
+// Encryption or Compression set describes no file: what follows it is the
+// ciphertext or compressed form of a stream that starts with the next header,
+// down to the real manifest.
+type Manifest struct {
+	Name    string `json:"name,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	// Streamed manifests are written before the data is read, so they
+	// have no size or hash. The encryption authenticates the data instead.
+	Streamed bool `json:"streamed,omitempty"`
+
+	Encryption  *crypto.StreamParams `json:"enc,omitempty"`
+	Compression string               `json:"compression,omitempty"`
+}
+
+func NewManifest(file *os.File) (Manifest, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("Error hashing file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Manifest{}, err
+	}
+
+	return Manifest{
+		Name:    filepath.Base(info.Name()),
+		Size:    size,
+		ModTime: info.ModTime().Unix(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func (m Manifest) MarshalBinary() ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(ManifestMagic)
+	buf.WriteByte(ManifestVersion)
+	binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// parseManifest reads a manifest from the start of data. It returns the number
+// of bytes consumed, or 0 with a nil error when more data is needed.
+func parseManifest(data []byte) (Manifest, int, error) {
+	if len(data) < manifestPrefixSize {
+		return Manifest{}, 0, nil
+	}
+	if version := data[len(ManifestMagic)]; version < 1 || version > ManifestVersion {
+		return Manifest{}, 0, fmt.Errorf("%w: %d", ErrManifestVersion, version)
+	}
+
+	length := int(binary.BigEndian.Uint32(data[len(ManifestMagic)+1:]))
+	if length > maxManifestSize {
+		return Manifest{}, 0, fmt.Errorf("Manifest too large (%d bytes)", length)
+	}
+	if len(data) < manifestPrefixSize+length {
+		return Manifest{}, 0, nil
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data[manifestPrefixSize:manifestPrefixSize+length], &m); err != nil {
+		return Manifest{}, 0, fmt.Errorf("Error reading manifest: %w", err)
+	}
+	return m, manifestPrefixSize + length, nil
+}
+
+// restoreWriter receives the decoded stream, strips the manifest and writes
+// the rest to the writer open returns, checking size and hash in Close.
+// Streams that do not start with the manifest magic are uploads from before
+// manifests existed and are written as they are, unless the writer is
+// encrypted, for uploads read through an index. An encrypted or compressed
+// stream is decrypted or inflated into a second restoreWriter, which finds the
+// next header.
+type restoreWriter struct {
+	Manifest *Manifest
+
+	password string
+	// open is called once the manifest is known, nil for uploads without
+	// one, and returns where the contents go.
+	open    func(m *Manifest) (io.Writer, error)
+	layer   io.WriteCloser
+	inner   *restoreWriter
+	pending []byte
+	legacy  bool
+	// encrypted requires the stream to be encrypted, refusing legacy and
+	// unauthenticated streams with ErrCorrupt.
+	encrypted bool
+	out       io.Writer
+	hash      hash.Hash
+	written   int64
+}
+
+func newRestoreWriter(password string, open func(m *Manifest) (io.Writer, error)) *restoreWriter {
+	return &restoreWriter{password: password, open: open, hash: sha256.New()}
+}
+
+func (w *restoreWriter) Write(p []byte) (int, error) {
+	if w.layer != nil {
+		_, err := w.layer.Write(p)
+		return len(p), err
+	}
+	if w.out != nil {
+		return len(p), w.write(p)
+	}
+
+	w.pending = append(w.pending, p...)
+	n := min(len(w.pending), len(ManifestMagic))
+	if !bytes.Equal(w.pending[:n], []byte(ManifestMagic)[:n]) {
+		if w.encrypted {
+			return 0, ErrCorrupt
+		}
+		w.legacy = true
+		return len(p), w.start()
+	}
+
+	m, consumed, err := parseManifest(w.pending)
+	if err != nil {
+		return 0, err
+	}
+	if consumed == 0 {
+		return len(p), nil
+	}
+
+	if w.encrypted && m.Encryption == nil {
+		return 0, ErrCorrupt
+	}
+	w.Manifest = &m
+	header, rest := w.pending[:consumed], w.pending[consumed:]
+	w.pending = nil
+	if m.Encryption != nil || m.Compression != "" {
+		return len(p), w.openLayer(header, rest)
+	}
+	w.pending = rest
+	return len(p), w.start()
+}
+
+// openLayer sets up decryption or decompression of everything after the
+// header. The header is authenticated along with every encrypted chunk.
+func (w *restoreWriter) openLayer(header, rest []byte) error {
+	w.inner = newRestoreWriter(w.password, w.open)
+
+	switch {
+	case w.Manifest.Encryption != nil:
+		key, err := w.Manifest.Encryption.Key(w.password)
+		if err != nil {
+			return err
+		}
+		w.layer, err = crypto.NewDecryptWriter(w.inner, key, *w.Manifest.Encryption, bytes.Clone(header))
+		if err != nil {
+			return err
+		}
+	case w.Manifest.Compression == CompressionGzip:
+		w.layer = newDecompressWriter(w.inner)
+	default:
+		return fmt.Errorf("Unsupported compression %q", w.Manifest.Compression)
+	}
+
+	_, err := w.layer.Write(rest)
+	return err
+}
+
+func (w *restoreWriter) start() error {
+	out, err := w.open(w.Manifest)
+	if err != nil {
+		return err
+	}
+	w.out = out
+
+	pending := w.pending
+	w.pending = nil
+	return w.write(pending)
+}
+
+func (w *restoreWriter) write(p []byte) error {
+	if _, err := w.out.Write(p); err != nil {
+		return fmt.Errorf("Error writing output: %w", err)
+	}
+	w.hash.Write(p)
+	w.written += int64(len(p))
+	return nil
+}
+
+func (w *restoreWriter) Close() error {
+	if w.layer != nil {
+		if err := w.layer.Close(); err != nil {
+			return err
+		}
+		err := w.inner.Close()
+		w.Manifest = w.inner.Manifest
+		return err
+	}
+	if w.out == nil {
+		if w.encrypted {
+			return ErrCorrupt
+		}
+		if w.Manifest == nil && len(w.pending) > 0 && len(w.pending) < manifestPrefixSize {
+			// Too short to hold a manifest: a tiny legacy upload.
+			w.legacy = true
+		}
+		if !w.legacy {
+			return errors.New("Stream ended before the manifest was complete")
+		}
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	return w.verify()
+}
+
+func (w *restoreWriter) verify() error {
+	if w.Manifest == nil || w.Manifest.Streamed {
+		return nil
+	}
+	if w.written != w.Manifest.Size {
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrSizeMismatch, w.written, w.Manifest.Size)
+	}
+	if sum := hex.EncodeToString(w.hash.Sum(nil)); sum != w.Manifest.SHA256 {
+		return fmt.Errorf("%w: got %s, expected %s", ErrChecksumMismatch, sum, w.Manifest.SHA256)
+	}
+	return nil
+}
+
+// fileOutput is where Reader restores a file: a temporary file next to Path,
+// named after the manifest when Path is "", which Commit renames into place
+// once the contents are checked. With discard set nothing is written at all.
+type fileOutput struct {
+	Path    string
+	discard bool
+	file    *os.File
+}
+
+func (f *fileOutput) open(m *Manifest) (io.Writer, error) {
+	if f.discard {
+		return io.Discard, nil
+	}
+	if f.Path == "" {
+		if m == nil {
+			return nil, ErrNoManifest
+		}
+		name := filepath.Base(m.Name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return nil, fmt.Errorf("Manifest file name %q is not usable, an output file name is required", m.Name)
+		}
+		f.Path = name
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Error opening output file: %w", err)
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	f.file = file
+	return file, nil
+}
+
+// Abort drops whatever was written so far.
+func (f *fileOutput) Abort() {
+	if f.file != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+		f.file = nil
+	}
+}
+
+// Commit moves the restored file into place with the modification time the
+// manifest m records.
+func (f *fileOutput) Commit(m *Manifest) error {
+	if f.file == nil {
+		return nil
+	}
+
+	tmp := f.file.Name()
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, f.Path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Error moving the restored file into place: %w", err)
+	}
+
+	if m != nil && m.ModTime != 0 {
+		mtime := time.Unix(m.ModTime, 0)
+		os.Chtimes(f.Path, mtime, mtime)
+	}
+	return nil
+}
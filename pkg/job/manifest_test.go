@@ -0,0 +1,42 @@
+package job
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRestoreWriterRequiresEncryption(t *testing.T) {
+	header, err := testManifest("plain", []byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"legacy", []byte("no manifest at all")},
+		{"tiny legacy", []byte("ab")},
+		{"unencrypted manifest", append(header, "hello"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, encrypted := range []bool{false, true} {
+				var out bytes.Buffer
+				w := newRestoreWriter(testPassword, func(*Manifest) (io.Writer, error) { return &out, nil })
+				w.encrypted = encrypted
+				_, err := w.Write(tt.stream)
+				if err == nil {
+					err = w.Close()
+				}
+				if encrypted != errors.Is(err, ErrCorrupt) {
+					t.Fatalf("Encrypted %v: got %v", encrypted, err)
+				}
+				if !encrypted && err != nil {
+					t.Fatalf("Unindexed stream: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package job
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	mathRand "math/rand/v2"
+	"sort"
+)
+
+// Track encodings. With EncodingSubstitution every track is the dictionary
+// entry of one symbol; with EncodingPermutation a playlist holds distinct
+// tracks and the payload, read as one big-endian number, is the rank of their
+// order among all orders of the same tracks (a Lehmer code). The set of tracks
+// itself carries nothing: the reader sorts them by URI to find the ranks, so
+// only the dictionary's size matters, and duplicates never appear.
+const (
+	EncodingSubstitution = ""
+	EncodingPermutation  = "permutation"
+)
+
+func validEncoding(encoding string) error {
+	switch encoding {
+	case EncodingSubstitution, EncodingPermutation:
+		return nil
+	}
+	return fmt.Errorf("Unsupported track encoding %q, expected substitution or permutation", encoding)
+}
+
+// ParseEncoding parses the name of a track encoding.
+func ParseEncoding(name string) (string, error) {
+	if name == "substitution" {
+		return EncodingSubstitution, nil
+	}
+	return name, validEncoding(name)
+}
+
+// recordsBytes is whether the index gives the payload length of every data
+// playlist, which the track count alone does not give for symbols wider than
+// 8 bits and permutations.
+func recordsBytes(width int, encoding string) bool {
+	return width > DefaultSymbolWidth || encoding == EncodingPermutation
+}
+
+// permutationCapacity is how many bytes the order of k distinct tracks holds:
+// the largest n such that 256^n <= k!.
+func permutationCapacity(k int) int {
+	return (factorial(k).BitLen() - 1) / 8
+}
+
+// permutationLength is the fewest tracks whose order holds n bytes.
+func permutationLength(n int) int {
+	f := big.NewInt(1)
+	k := 1
+	for (f.BitLen()-1)/8 < n {
+		k++
+		f.Mul(f, big.NewInt(int64(k)))
+	}
+	return k
+}
+
+func factorial(k int) *big.Int {
+	return new(big.Int).MulRange(1, int64(max(k, 1)))
+}
+
+// encodePermutation returns the tracks of a playlist holding payload: the
+// fewest distinct tracks of pool that can, ordered by payload. Which tracks
+// are taken only depends on payload, so that a resumed upload picks the same.
+func encodePermutation(payload []byte, pool []string) ([]string, error) {
+	k := permutationLength(len(payload))
+	if k > len(pool) {
+		return nil, fmt.Errorf("%d bytes need %d distinct tracks, the dictionary holds %d", len(payload), k, len(pool))
+	}
+
+	sum := sha256.Sum256(payload)
+	r := mathRand.New(mathRand.NewPCG(binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16])))
+	picked := make(map[int]bool, k)
+	set := make([]string, 0, k)
+	for len(set) < k {
+		i := r.IntN(len(pool))
+		if !picked[i] {
+			picked[i] = true
+			set = append(set, pool[i])
+		}
+	}
+	sort.Strings(set)
+
+	// The factorial number system digits of the payload, least
+	// significant first, are the Lehmer code read from the end.
+	x := new(big.Int).SetBytes(payload)
+	digits := make([]int, k)
+	radix, digit := new(big.Int), new(big.Int)
+	for j := 1; j <= k; j++ {
+		x.QuoRem(x, radix.SetInt64(int64(j)), digit)
+		digits[k-j] = int(digit.Int64())
+	}
+
+	remaining := newRankTree(k)
+	tracks := make([]string, k)
+	for i, d := range digits {
+		rank := remaining.nth(d)
+		remaining.remove(rank)
+		tracks[i] = set[rank]
+	}
+	return tracks, nil
+}
+
+// decodePermutation returns the length bytes the order of tracks holds.
+func decodePermutation(tracks []string, length int) ([]byte, error) {
+	k := len(tracks)
+	set := append([]string(nil), tracks...)
+	sort.Strings(set)
+	ranks := make(map[string]int, k)
+	for rank, uri := range set {
+		if rank > 0 && set[rank-1] == uri {
+			return nil, fmt.Errorf("Track %s appears twice in a permutation", uri)
+		}
+		ranks[uri] = rank
+	}
+
+	remaining := newRankTree(k)
+	x := new(big.Int)
+	radix, digit := new(big.Int), new(big.Int)
+	for i, uri := range tracks {
+		rank := ranks[uri]
+		d := remaining.before(rank)
+		remaining.remove(rank)
+		x.Mul(x, radix.SetInt64(int64(k-i)))
+		x.Add(x, digit.SetInt64(int64(d)))
+	}
+
+	if (x.BitLen()+7)/8 > length {
+		return nil, errors.New("Permutation holds more than the expected payload")
+	}
+	return x.FillBytes(make([]byte, length)), nil
+}
+
+// rankTree is a Fenwick tree over the ranks 0 to n-1 still available, which
+// finds the d-th available rank and counts the available ranks below one in
+// O(log n).
+type rankTree []int
+
+func newRankTree(n int) rankTree {
+	t := make(rankTree, n+1)
+	for i := 1; i <= n; i++ {
+		t[i]++
+		if parent := i + i&-i; parent <= n {
+			t[parent] += t[i]
+		}
+	}
+	return t
+}
+
+func (t rankTree) remove(rank int) {
+	for i := rank + 1; i < len(t); i += i & -i {
+		t[i]--
+	}
+}
+
+// before counts the available ranks below rank.
+func (t rankTree) before(rank int) int {
+	n := 0
+	for i := rank; i > 0; i -= i & -i {
+		n += t[i]
+	}
+	return n
+}
+
+// nth returns the d-th available rank, counting from 0.
+func (t rankTree) nth(d int) int {
+	pos := 0
+	step := 1
+	for step*2 < len(t) {
+		step *= 2
+	}
+	for ; step > 0; step /= 2 {
+		if next := pos + step; next < len(t) && t[next] <= d {
+			pos = next
+			d -= t[next]
+		}
+	}
+	return pos
+}
@@ -0,0 +1,140 @@
+package job
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"spotifyfs/pkg/spotify/spotifytest"
+	"testing"
+)
+
+func testPool(n int) []string {
+	pool := make([]string, n)
+	for i := range pool {
+		pool[i] = fmt.Sprintf("spotify:track:%022d", i)
+	}
+	// Entries are not in URI order in a real dictionary.
+	rand.New(rand.NewSource(int64(n))).Shuffle(n, func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+	return pool
+}
+
+func checkPermutation(t *testing.T, payload []byte, pool []string) []string {
+	t.Helper()
+	tracks, err := encodePermutation(payload, pool)
+	if err != nil {
+		t.Fatalf("%d bytes: %v", len(payload), err)
+	}
+	seen := make(map[string]bool, len(tracks))
+	for _, uri := range tracks {
+		if seen[uri] {
+			t.Fatalf("%d bytes: track %s used twice", len(payload), uri)
+		}
+		seen[uri] = true
+	}
+	got, err := decodePermutation(tracks, len(payload))
+	if err != nil {
+		t.Fatalf("%d bytes: %v", len(payload), err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("%d bytes: decoded %x, want %x", len(payload), got, payload)
+	}
+	return tracks
+}
+
+func TestPermutationSingleTrack(t *testing.T) {
+	if got := permutationCapacity(1); got != 0 {
+		t.Fatalf("One track holds %d bytes", got)
+	}
+	tracks := checkPermutation(t, nil, testPool(1))
+	if len(tracks) != 1 {
+		t.Fatalf("An empty payload takes %d tracks", len(tracks))
+	}
+}
+
+func TestPermutationEveryByte(t *testing.T) {
+	pool := testPool(256)
+	for b := range 256 {
+		checkPermutation(t, []byte{byte(b)}, pool)
+		checkPermutation(t, []byte{byte(b), 0xff, byte(255 - b)}, pool)
+	}
+}
+
+func TestPermutationFullPlaylist(t *testing.T) {
+	tests := []struct {
+		width    int
+		capacity int
+	}{
+		{8, 210},
+		{12, 5406},
+		{16, 14807},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.width), func(t *testing.T) {
+			k := min(1<<tt.width, maxBytesPerPlaylist)
+			if got := permutationCapacity(k); got != tt.capacity {
+				t.Fatalf("Capacity is %d bytes, want %d", got, tt.capacity)
+			}
+			if got := permutationLength(tt.capacity); got > k {
+				t.Fatalf("%d bytes need %d tracks, more than %d", tt.capacity, got, k)
+			}
+
+			pool := testPool(k)
+			for _, payload := range [][]byte{testData(tt.capacity), bytes.Repeat([]byte{0xff}, tt.capacity), make([]byte, tt.capacity)} {
+				checkPermutation(t, payload, pool)
+			}
+			if _, err := encodePermutation(testData(tt.capacity+1), pool); err == nil {
+				t.Fatal("Encoded a payload past the capacity")
+			}
+		})
+	}
+}
+
+func TestDecodePermutationRejectsRepeatedTrack(t *testing.T) {
+	tracks := checkPermutation(t, testData(100), testPool(256))
+	tracks[len(tracks)-1] = tracks[0]
+	if _, err := decodePermutation(tracks, 100); err == nil {
+		t.Fatal("Decoded a permutation with a repeated track")
+	}
+}
+
+func TestPermutationRejectsUnknownTrack(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	data := testData(2000)
+	id := put(t, client, "unknown", data, WriteOptions{Compression: CompressionNone, Encoding: EncodingPermutation})
+
+	p := dataPlaylists(srv, "unknown")[0]
+	srv.SetTrack(p.ID, 3, "spotify:track:notinthedictionary")
+	_, err := get(client, id, ReadOptions{})
+	var unknown *ErrUnknownTrack
+	if !errors.As(err, &unknown) || unknown.Position != 3 {
+		t.Fatalf("Get returned %v, want an unknown track at position 3", err)
+	}
+}
+
+func TestRankTree(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 8, 100} {
+		tree := newRankTree(n)
+		available := make([]int, n)
+		for i := range available {
+			available[i] = i
+		}
+		rng := rand.New(rand.NewSource(int64(n)))
+		for len(available) > 0 {
+			for d, rank := range available {
+				if got := tree.nth(d); got != rank {
+					t.Fatalf("n=%d: nth(%d) = %d, want %d", n, d, got, rank)
+				}
+				if got := tree.before(rank); got != d {
+					t.Fatalf("n=%d: before(%d) = %d, want %d", n, rank, got, d)
+				}
+			}
+			i := rng.Intn(len(available))
+			tree.remove(available[i])
+			available = slices.Delete(available, i, i+1)
+		}
+	}
+}
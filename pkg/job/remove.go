@@ -0,0 +1,108 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"spotifyfs/pkg/spotify"
+)
+
+var ErrRemoveAborted = errors.New("Aborted, nothing was removed")
+
+// RemoveOptions selects where Remove finds the playlists of an upload and
+// whether it removes them.
+type RemoveOptions struct {
+	// Journal is the path of an upload journal to take the playlists from
+	// instead of following the chain. It also finds the playlists of an
+	// unfinished upload that are not linked into the chain yet, and is
+	// deleted once they are removed.
+	Journal string
+	// DryRun only lists the playlists.
+	DryRun bool
+	// Confirm is asked with the number of playlists found before any of
+	// them is removed. Nil removes without asking.
+	Confirm func(playlists int) bool
+}
+
+// Remove unfollows every playlist of the upload starting at playlistID, or
+// of the one recorded in opts.Journal, which is how Spotify deletes the
+// playlists a user owns. The chain is walked to the end before anything is
+// removed. Spotify keeps unfollowed playlists readable by ID and unfollowing
+// one again succeeds, so an interrupted run can be started again with the
+// same ID: it walks the whole chain and unfollows every playlist again.
+func Remove(s *spotify.SpotifyClient, playlistID string, opts RemoveOptions) error {
+	ctx := context.Background()
+
+	var playlists []spotify.PlaylistDetails
+	var err error
+	if opts.Journal != "" {
+		playlists, err = journalPlaylists(ctx, s, opts.Journal)
+	} else {
+		err = WalkChain(ctx, s, playlistID, func(p spotify.PlaylistDetails) error {
+			playlists = append(playlists, p)
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	tracks := 0
+	for _, p := range playlists {
+		fmt.Printf("%-24s %6d tracks  %s\n", p.ID, p.Tracks.Total, p.Name)
+		tracks += p.Tracks.Total
+	}
+	fmt.Printf("%d playlist(s), %d tracks\n", len(playlists), tracks)
+	if opts.DryRun {
+		return nil
+	}
+	if opts.Confirm != nil && !opts.Confirm(len(playlists)) {
+		return ErrRemoveAborted
+	}
+
+	for i := len(playlists) - 1; i >= 0; i-- {
+		if err := s.UnfollowPlaylist(ctx, playlists[i].ID); err != nil {
+			return fmt.Errorf("%w (%d of %d playlist(s) removed)", err, len(playlists)-1-i, len(playlists))
+		}
+		fmt.Printf("Removed %s\n", playlists[i].ID)
+	}
+
+	if opts.Journal != "" {
+		if err := os.Remove(opts.Journal); err != nil {
+			return fmt.Errorf("Error deleting journal: %w", err)
+		}
+	}
+	fmt.Printf("Removed %d playlist(s)\n", len(playlists))
+	return nil
+}
+
+// journalPlaylists returns the playlists a journal records, index playlists
+// first like WalkChain, leaving out the ones that no longer exist.
+func journalPlaylists(ctx context.Context, s *spotify.SpotifyClient, path string) ([]spotify.PlaylistDetails, error) {
+	journal, err := LoadJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var playlists []spotify.PlaylistDetails
+	ids := append(journal.PlaylistIDs(IndexChain), journal.PlaylistIDs(DataChain)...)
+	for _, id := range ids {
+		details, err := s.GetPlaylistDetails(ctx, id)
+		if notFound(err) {
+			fmt.Printf("%-24s no longer exists\n", id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, details)
+	}
+	return playlists, nil
+}
+
+func notFound(err error) bool {
+	var apiErr *spotify.APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
@@ -0,0 +1,38 @@
+package job
+
+import (
+	"context"
+	"net/http"
+	"spotifyfs/pkg/spotify/spotifytest"
+	"testing"
+)
+
+func TestRemoveCanBeRunAgain(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	id := put(t, client, "removed", testData(25000), WriteOptions{Compression: CompressionNone})
+	if len(srv.Playlists()) < 3 {
+		t.Fatalf("Upload has %d playlists, want a chain", len(srv.Playlists()))
+	}
+
+	// The head is removed last: fail there, once the rest is unfollowed.
+	srv.Inject(spotifytest.Fault{Method: http.MethodDelete, Path: "/v1/playlists/" + id + "/", Status: http.StatusForbidden, Times: 1})
+	if err := Remove(client, id, RemoveOptions{}); err == nil {
+		t.Fatal("Remove succeeded despite the fault")
+	}
+	if got := srv.Playlists(); len(got) != 1 || got[0].ID != id {
+		t.Fatalf("After the interrupted run %d playlists are left, want the head", len(got))
+	}
+
+	if err := Remove(client, id, RemoveOptions{}); err != nil {
+		t.Fatalf("Second Remove: %v", err)
+	}
+	uploads, err := List(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 0 || len(srv.Playlists()) != 0 {
+		t.Fatalf("%d uploads and %d playlists left", len(uploads), len(srv.Playlists()))
+	}
+}
@@ -0,0 +1,73 @@
+package job
+
+import "fmt"
+
+const (
+	DefaultSymbolWidth = 8
+	maxSymbolWidth     = 16
+)
+
+func validWidth(width int) error {
+	if width < DefaultSymbolWidth || width > maxSymbolWidth {
+		return fmt.Errorf("Unsupported symbol width %d, expected 8 to 16 bits", width)
+	}
+	return nil
+}
+
+// playlistCapacity is how many bytes fit in one playlist with symbols of the
+// given width.
+func playlistCapacity(width int) int {
+	return maxBytesPerPlaylist * width / 8
+}
+
+// packSymbols cuts data into width-bit symbols, most significant bit first,
+// padding the last one with zeros.
+func packSymbols(data []byte, width int) []uint16 {
+	if width == 8 {
+		symbols := make([]uint16, len(data))
+		for i, b := range data {
+			symbols[i] = uint16(b)
+		}
+		return symbols
+	}
+
+	symbols := make([]uint16, 0, (len(data)*8+width-1)/width)
+	var acc uint32
+	bits := 0
+	for _, b := range data {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= width {
+			bits -= width
+			symbols = append(symbols, uint16(acc>>bits)&(1<<width-1))
+		}
+	}
+	if bits > 0 {
+		symbols = append(symbols, uint16(acc<<(width-bits))&(1<<width-1))
+	}
+	return symbols
+}
+
+// unpackSymbols turns symbols back into length bytes. A byte is erased when
+// any of its bits comes from an erased symbol.
+func unpackSymbols(symbols []uint16, erased []bool, width, length int) ([]byte, []bool, error) {
+	if (length*8+width-1)/width != len(symbols) {
+		return nil, nil, fmt.Errorf("%w: %d tracks of %d bits cannot hold %d bytes", ErrIndexMismatch, len(symbols), width, length)
+	}
+
+	data := make([]byte, length)
+	dataErased := make([]bool, length)
+	for i := range data {
+		var b uint16
+		for bit := 0; bit < 8; bit++ {
+			position := i*8 + bit
+			symbol := position / width
+			if erased[symbol] {
+				dataErased[i] = true
+			}
+			b = b<<1 | symbols[symbol]>>(width-1-position%width)&1
+		}
+		data[i] = byte(b)
+	}
+	return data, dataErased, nil
+}
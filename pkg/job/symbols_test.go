@@ -0,0 +1,73 @@
+package job
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPackSymbolsRoundTrip(t *testing.T) {
+	for width := DefaultSymbolWidth; width <= maxSymbolWidth; width++ {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			// The bits of width bytes fill whole symbols, so these
+			// lengths end the last symbol at every possible bit.
+			for length := 0; length <= 2*width; length++ {
+				data := testData(length)
+				symbols := packSymbols(data, width)
+				if want := (length*8 + width - 1) / width; len(symbols) != want {
+					t.Fatalf("%d bytes packed into %d symbols, want %d", length, len(symbols), want)
+				}
+				for _, symbol := range symbols {
+					if int(symbol) >= 1<<width {
+						t.Fatalf("%d bytes: symbol %d does not fit in %d bits", length, symbol, width)
+					}
+				}
+				if padding := len(symbols)*width - length*8; padding > 0 {
+					if last := symbols[len(symbols)-1]; last&(1<<padding-1) != 0 {
+						t.Fatalf("%d bytes: last symbol %b is not padded with zeros", length, last)
+					}
+				}
+
+				got, erased, err := unpackSymbols(symbols, make([]bool, len(symbols)), width, length)
+				if err != nil {
+					t.Fatalf("%d bytes: %v", length, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("%d bytes: unpacked %x, want %x", length, got, data)
+				}
+				for i, e := range erased {
+					if e {
+						t.Fatalf("%d bytes: byte %d erased", length, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackSymbolsErasures(t *testing.T) {
+	const width, length = 12, 9
+	symbols := packSymbols(testData(length), width)
+	erased := make([]bool, len(symbols))
+	// Symbol 1 holds bits 12 to 23: the end of byte 1 and all of byte 2.
+	erased[1] = true
+	_, dataErased, err := unpackSymbols(symbols, erased, width, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range dataErased {
+		if want := i == 1 || i == 2; e != want {
+			t.Fatalf("Byte %d erased %v, want %v", i, e, want)
+		}
+	}
+}
+
+func TestUnpackSymbolsRejectsWrongLength(t *testing.T) {
+	symbols := packSymbols(testData(10), 12)
+	for _, length := range []int{8, 12} {
+		if _, _, err := unpackSymbols(symbols, make([]bool, len(symbols)), 12, length); !errors.Is(err, ErrIndexMismatch) {
+			t.Fatalf("%d bytes: got %v, want ErrIndexMismatch", length, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"spotifyfs/pkg/spotify"
+)
+
+// Visibilities of the playlists of an upload. Private playlists, the default,
+// stay off the owner's profile and can only be read by the account that owns
+// them; collaborative ones are private too, but the users invited to them can
+// read them.
+const (
+	VisibilityPrivate       = "private"
+	VisibilityPublic        = "public"
+	VisibilityCollaborative = "collaborative"
+)
+
+// ParseVisibility parses the name of a visibility, "" giving the default.
+func ParseVisibility(name string) (string, error) {
+	switch name {
+	case "":
+		return VisibilityPrivate, nil
+	case VisibilityPrivate, VisibilityPublic, VisibilityCollaborative:
+		return name, nil
+	}
+	return "", fmt.Errorf("Unknown visibility %q, expected private, public or collaborative", name)
+}
+
+func visibilityFlags(visibility string) (public, collaborative bool) {
+	return visibility == VisibilityPublic, visibility == VisibilityCollaborative
+}
+
+// playlistInfo is how playlists of the given visibility are created.
+func playlistInfo(visibility string) spotify.PlaylistInfo {
+	public, collaborative := visibilityFlags(visibility)
+	return spotify.PlaylistInfo{Public: &public, Collaborative: &collaborative}
+}
+
+// VisibilityOf returns the visibility of a playlist.
+func VisibilityOf(p spotify.PlaylistDetails) string {
+	switch {
+	case p.Collaborative:
+		return VisibilityCollaborative
+	case p.Public:
+		return VisibilityPublic
+	}
+	return VisibilityPrivate
+}
+
+// SetVisibility changes the visibility of every playlist of the upload
+// starting at playlistID. Playlists that already have it are left alone, so
+// an interrupted run can be started again.
+func SetVisibility(s *spotify.SpotifyClient, playlistID, target string) error {
+	ctx := context.Background()
+	target, err := ParseVisibility(target)
+	if err != nil {
+		return err
+	}
+
+	var playlists []spotify.PlaylistDetails
+	err = WalkChain(ctx, s, playlistID, func(p spotify.PlaylistDetails) error {
+		playlists = append(playlists, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	public, collaborative := visibilityFlags(target)
+	changed := 0
+	for _, p := range playlists {
+		if VisibilityOf(p) == target {
+			continue
+		}
+		if err := s.SetPlaylistVisibility(ctx, p.ID, public, collaborative); err != nil {
+			return fmt.Errorf("%w (%d of %d playlist(s) changed)", err, changed, len(playlists))
+		}
+		changed++
+		fmt.Printf("Made %s %s\n", p.ID, target)
+	}
+	fmt.Printf("%d playlist(s) made %s, %d already were\n", changed, target, len(playlists)-changed)
+	return nil
+}
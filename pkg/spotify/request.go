@@ -0,0 +1,266 @@
+package spotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathRand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrMaybeApplied wraps the failure of a request that is not safe to send
+// twice, such as adding tracks, once it may have reached the server. Do does
+// not retry it: the caller has to find out whether it took effect.
+var ErrMaybeApplied = errors.New("The request may have been applied, it was not retried")
+
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first one.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// MaxJitter is added at random to every wait so that parallel workers
+	// do not retry in lockstep.
+	MaxJitter time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 8,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    1 * time.Minute,
+	MaxJitter:   1 * time.Second,
+}
+
+type Request struct {
+	Method string
+	URL    string
+	// Query is merged into the query string already present in URL.
+	Query url.Values
+	// Body is sent as JSON when not nil.
+	Body any
+	// RawBody is sent as is, with ContentType, instead of Body.
+	RawBody     []byte
+	ContentType string
+	// Anonymous requests carry no access token, e.g. for the image CDN.
+	Anonymous bool
+}
+
+type APIError struct {
+	Method  string
+	URL     string
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Spotify API error on %s %s (%d)", e.Method, e.URL, e.Status)
+	}
+	return fmt.Sprintf("Spotify API error on %s %s (%d): %s", e.Method, e.URL, e.Status, e.Message)
+}
+
+// tokenInvalidator is implemented by token sources that can be told the
+// current access token was rejected, e.g. PersistentTokenSource.
+type tokenInvalidator interface {
+	Invalidate()
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func (p RetryPolicy) jitter() time.Duration {
+	if p.MaxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(mathRand.Int64N(int64(p.MaxJitter)))
+}
+
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *SpotifyClient) retryPolicy() RetryPolicy {
+	policy := s.WebConfig.Retry
+	if policy.MaxAttempts <= 0 {
+		return DefaultRetryPolicy
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return policy
+}
+
+// Do sends r to the Web API and decodes a successful JSON response into out
+// (which may be nil), or copies it as is when out is a *[]byte. Rate limits
+// (429, honouring Retry-After), 5xx answers and network errors are retried
+// with exponential backoff until the policy's attempt budget is spent; a 401
+// forces a token refresh before retrying. POST requests are only retried when
+// the server cannot have acted on them, otherwise the failure is wrapped in
+// ErrMaybeApplied. Any other status is returned as an *APIError.
+func (s *SpotifyClient) Do(ctx context.Context, r Request, out any) error {
+	payload := r.RawBody
+	if payload == nil && r.Body != nil {
+		var err error
+		payload, err = json.Marshal(r.Body)
+		if err != nil {
+			return fmt.Errorf("Error marshaling struct: %w", err)
+		}
+	}
+
+	policy := s.retryPolicy()
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		wait, retry, err := s.try(ctx, r, payload, out)
+		if err == nil {
+			return nil
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+		lastErr = err
+
+		if attempt == policy.MaxAttempts {
+			break
+		}
+		if wait == 0 {
+			wait = policy.backoff(attempt)
+		}
+		wait += policy.jitter()
+		log.Printf("%v. Retrying in %s (attempt %d/%d)...", err, wait.Round(time.Millisecond), attempt, policy.MaxAttempts)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Giving up on %s %s after %d attempts: %w", r.Method, r.URL, policy.MaxAttempts, lastErr)
+}
+
+// try performs a single attempt and reports whether a failure is worth
+// retrying, and after how long if the server said so.
+func (s *SpotifyClient) try(ctx context.Context, r Request, payload []byte, out any) (time.Duration, bool, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, body)
+	if err != nil {
+		return 0, false, fmt.Errorf("Error creating the request: %w", err)
+	}
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for key, values := range r.Query {
+			for _, value := range values {
+				query.Add(key, value)
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	switch {
+	case r.ContentType != "":
+		req.Header.Set("Content-Type", r.ContentType)
+	case payload != nil:
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if !r.Anonymous {
+		if err := s.Auth.Authorize(req); err != nil {
+			return 0, true, err
+		}
+	}
+
+	// Once a POST may have been received, sending it again could apply it
+	// twice.
+	idempotent := r.Method != http.MethodPost
+	maybeApplied := func(wait time.Duration, err error) (time.Duration, bool, error) {
+		if idempotent {
+			return wait, true, err
+		}
+		return 0, false, fmt.Errorf("%w: %w", ErrMaybeApplied, err)
+	}
+
+	resp, err := s.WebConfig.Client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("Error while doing request: %w", err)
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return 0, true, err
+		}
+		return maybeApplied(0, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if out == nil || resp.StatusCode == http.StatusNoContent {
+			return 0, false, nil
+		}
+		if raw, ok := out.(*[]byte); ok {
+			if *raw, err = io.ReadAll(resp.Body); err != nil {
+				return maybeApplied(0, fmt.Errorf("Error reading response: %w", err))
+			}
+			return 0, false, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return maybeApplied(0, fmt.Errorf("Error decoding JSON response: %w", err))
+		}
+		return 0, false, nil
+
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait, ok := retryAfter(resp)
+		if !ok {
+			wait = RateLimitWaitTime * time.Second
+		}
+		return wait, true, fmt.Errorf("Rate limit (429) on %s %s", r.Method, r.URL)
+
+	case resp.StatusCode == http.StatusUnauthorized && !r.Anonymous:
+		if invalidator, ok := s.Auth.TokenSource.(tokenInvalidator); ok {
+			invalidator.Invalidate()
+			return 0, true, fmt.Errorf("Access token rejected (401) on %s %s", r.Method, r.URL)
+		}
+
+	case resp.StatusCode >= 500:
+		wait, _ := retryAfter(resp)
+		return maybeApplied(wait, fmt.Errorf("Server error (%d) on %s %s", resp.StatusCode, r.Method, r.URL))
+	}
+
+	apiErr := &APIError{Method: r.Method, URL: r.URL, Status: resp.StatusCode}
+	var errResp ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil {
+		apiErr.Message = errResp.Error.Message
+	}
+	return 0, false, apiErr
+}
@@ -0,0 +1,80 @@
+package spotify_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"spotifyfs/pkg/spotify"
+	"spotifyfs/pkg/spotify/spotifytest"
+	"testing"
+)
+
+func TestDoRetriesIdempotentRequests(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	ctx := context.Background()
+
+	id, err := client.CreatePlaylist(ctx, spotify.PlaylistInfo{Name: "retry"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Inject(spotifytest.Fault{Method: http.MethodGet, Status: http.StatusBadGateway, Times: 2})
+	if _, err := client.GetPlaylistDetails(ctx, id); err != nil {
+		t.Fatalf("GET failed despite retries: %v", err)
+	}
+}
+
+func TestDoDoesNotRepeatAppliedPost(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault spotifytest.Fault
+		// tracks is how many tracks the playlist holds afterwards.
+		tracks int
+	}{
+		{"lost response", spotifytest.Fault{Status: http.StatusBadGateway, After: true}, 2},
+		{"server error", spotifytest.Fault{Status: http.StatusBadGateway}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := spotifytest.NewServer()
+			defer srv.Close()
+			client := srv.NewClient()
+			ctx := context.Background()
+
+			id, err := client.CreatePlaylist(ctx, spotify.PlaylistInfo{Name: "post"}, "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.fault.Method, tt.fault.Path, tt.fault.Times = http.MethodPost, "/v1/playlists/"+id+"/tracks", 1
+			srv.Inject(tt.fault)
+			before := srv.Requests()
+
+			err = client.AddToPlaylist(ctx, spotify.SpotifyAddPlaylist{MusicURIS: []string{"spotify:track:a", "spotify:track:b"}}, id)
+			if !errors.Is(err, spotify.ErrMaybeApplied) {
+				t.Fatalf("AddToPlaylist returned %v, want ErrMaybeApplied", err)
+			}
+			if n := srv.Requests() - before; n != 1 {
+				t.Errorf("%d requests sent, want 1", n)
+			}
+			p, _ := srv.Playlist(id)
+			if len(p.Tracks) != tt.tracks {
+				t.Errorf("Playlist holds %d tracks, want %d", len(p.Tracks), tt.tracks)
+			}
+		})
+	}
+}
+
+func TestDoRetriesRateLimitedPost(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+
+	srv.Inject(spotifytest.Fault{Method: http.MethodPost, Status: http.StatusTooManyRequests, Times: 1})
+	if _, err := client.CreatePlaylist(context.Background(), spotify.PlaylistInfo{Name: "limited"}, "", 0); err != nil {
+		t.Fatalf("Rate limited POST was not retried: %v", err)
+	}
+	if n := len(srv.Playlists()); n != 1 {
+		t.Errorf("%d playlists created, want 1", n)
+	}
+}
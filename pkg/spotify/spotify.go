@@ -1,35 +1,56 @@
 package spotify
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
-	mathRand "math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/spotify"
 )
 
-var ErrNoMorePlaylist = errors.New("No more playlist")
+var (
+	ErrNoMorePlaylist = errors.New("No more playlist")
+	ErrNoCover        = errors.New("Playlist has no cover image")
+)
 
 const (
 	SpotifyMaxTracksPerRequest = 100
-	ServerPort                 = ":8080"
+	DefaultListenAddr          = "127.0.0.1:8080"
+	DefaultRedirectURL         = "http://127.0.0.1:8080/callback/spotify"
 	RateLimitWaitTime          = 5
 )
 
+const (
+	// SpotifyMaxTracksPerLookup is how many IDs GET /v1/tracks accepts.
+	SpotifyMaxTracksPerLookup = 50
+	// DefaultMarket is the market searches and track lookups are made in,
+	// which decides what tracks are playable and how they are relinked.
+	DefaultMarket = "US"
+	// SpotifyMaxCoverSize is the largest cover upload accepted, once base64
+	// encoded.
+	SpotifyMaxCoverSize = 256 * 1024
+	// SpotifyMaxPlaylistsPerPage is the largest page of GET /v1/me/playlists.
+	SpotifyMaxPlaylistsPerPage = 50
+)
+
 type AuthSpotify struct {
-	Config   *oauth2.Config
-	Verifier string
-	Token    *oauth2.Token
-	Done     chan struct{}
+	mu          sync.Mutex
+	Config      *oauth2.Config
+	Verifier    string
+	State       string
+	Token       *oauth2.Token
+	TokenSource oauth2.TokenSource
+	Done        chan struct{}
 }
 
 type SpotifyClient struct {
@@ -49,12 +70,17 @@ type SpotifyHTTPClient interface {
 
 type WebClient struct {
 	Client                SpotifyHTTPClient
+	Retry                 RetryPolicy
 	SpotifySearchURL      string
 	SpotifyUserURL        string
 	CreatePlaylistURL     string
 	PlaylistURL           string
 	ChangePlaylistDetails string
 	GetPlaylist           string
+	UnfollowPlaylistURL   string
+	TracksURL             string
+	PlaylistImagesURL     string
+	MyPlaylistsURL        string
 }
 
 type SpotifySearchResponse struct {
@@ -73,6 +99,26 @@ type PlaylistInfo struct {
 	Name        string `json:"name,omitempty"`
 	Description string `json:"description,omitempty"`
 	Public      *bool  `json:"public,omitempty"`
+	// Collaborative playlists cannot be public.
+	Collaborative *bool `json:"collaborative,omitempty"`
+}
+
+type PlaylistDetails struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	Description   string        `json:"description"`
+	Public        bool          `json:"public"`
+	Collaborative bool          `json:"collaborative"`
+	Owner         SpotifyUserID `json:"owner"`
+	Tracks        struct {
+		Total int `json:"total"`
+	} `json:"tracks"`
+}
+
+// PlaylistPage is one page of the playlists of the current user.
+type PlaylistPage struct {
+	Next  string            `json:"next"`
+	Items []PlaylistDetails `json:"items"`
 }
 
 type PlaylistItems struct {
@@ -80,10 +126,44 @@ type PlaylistItems struct {
 	Items []struct {
 		Track struct {
 			Uri string `json:"uri"`
+			// LinkedFrom is the track that was added to the playlist
+			// when Spotify relinked it to another one for the market.
+			LinkedFrom *LinkedTrack `json:"linked_from"`
 		} `json:"track"`
 	} `json:"items"`
 }
 
+type LinkedTrack struct {
+	ID  string `json:"id"`
+	URI string `json:"uri"`
+}
+
+// Track is a track as returned by GET /v1/tracks for a market.
+type Track struct {
+	ID         string       `json:"id"`
+	URI        string       `json:"uri"`
+	IsPlayable *bool        `json:"is_playable"`
+	LinkedFrom *LinkedTrack `json:"linked_from"`
+	// Restrictions explains why a track is not playable.
+	Restrictions *TrackRestrictions `json:"restrictions"`
+}
+
+type TrackRestrictions struct {
+	Reason string `json:"reason"`
+}
+
+type TracksResponse struct {
+	Tracks []*Track `json:"tracks"`
+}
+
+// Image is one size of a cover. Width and Height are unknown for some
+// images.
+type Image struct {
+	URL    string `json:"url"`
+	Width  *int   `json:"width"`
+	Height *int   `json:"height"`
+}
+
 type ErrorDetail struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
@@ -110,7 +190,7 @@ func (c *RateLimitedHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	return c.Client.Do(req)
 }
 
-func NewAuthHandler() (*AuthSpotify, error) {
+func NewAuthHandler(redirectURL string) (*AuthSpotify, error) {
 	clientID, exist := os.LookupEnv("SPOTIFY_CLIENTID")
 	if !exist {
 		return nil, errors.New("SPOTIFY_CLIENTID system env var not found")
@@ -121,12 +201,19 @@ func NewAuthHandler() (*AuthSpotify, error) {
 		return nil, errors.New("SPOTIFY_CLIENTSECRET system env var not found")
 	}
 
+	if redirectURL == "" {
+		redirectURL = DefaultRedirectURL
+	}
+	if _, err := url.Parse(redirectURL); err != nil {
+		return nil, fmt.Errorf("Invalid redirect URI: %w", err)
+	}
+
 	conf := &oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		Scopes:       []string{"playlist-read-private", "playlist-read-collaborative", "playlist-modify-private", "playlist-modify-public"},
+		Scopes:       []string{"playlist-read-private", "playlist-read-collaborative", "playlist-modify-private", "playlist-modify-public", "ugc-image-upload"},
 		Endpoint:     spotify.Endpoint,
-		RedirectURL:  fmt.Sprintf("http://127.0.0.1%s/callback/spotify", ServerPort),
+		RedirectURL:  redirectURL,
 	}
 
 	authStruct := &AuthSpotify{
@@ -139,28 +226,109 @@ func NewAuthHandler() (*AuthSpotify, error) {
 }
 
 func (a *AuthSpotify) exchangeToToken(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
+	query := r.URL.Query()
+	if query.Get("state") != a.State {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		log.Println("Callback received with an invalid state, ignoring it")
+		return
+	}
+	if authErr := query.Get("error"); authErr != "" {
+		http.Error(w, "Authorization failed: "+authErr, http.StatusBadRequest)
+		log.Printf("Authorization failed: %s\n", authErr)
+		return
+	}
+
+	code := query.Get("code")
 	if code == "" {
 		fmt.Println("Code not found")
 		return
 	}
-	token, err := a.Config.Exchange(context.Background(), code, oauth2.VerifierOption(a.Verifier))
-	if err != nil {
-		log.Printf("Failed to exchange token.: %s\n", err.Error())
+	if err := a.exchange(r.Context(), code); err != nil {
+		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
+	fmt.Fprint(w, "Authenticated successfully! You can close this window.")
+}
+
+// ExchangeRedirect finishes a headless login from what the user pasted: either
+// the full URL the browser was redirected to, or just the code parameter.
+func (a *AuthSpotify) ExchangeRedirect(ctx context.Context, input string) error {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return errors.New("Empty redirect URL")
+	}
+
+	code := input
+	if strings.Contains(input, "?") {
+		redirect, err := url.Parse(input)
+		if err != nil {
+			return fmt.Errorf("Invalid redirect URL: %w", err)
+		}
+		query := redirect.Query()
+		if authErr := query.Get("error"); authErr != "" {
+			return fmt.Errorf("Authorization failed: %s", authErr)
+		}
+		if query.Get("state") != a.State {
+			return errors.New("State mismatch in redirect URL")
+		}
+		code = query.Get("code")
+		if code == "" {
+			return errors.New("Code not found in redirect URL")
+		}
+	}
+
+	return a.exchange(ctx, code)
+}
+
+func (a *AuthSpotify) exchange(ctx context.Context, code string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Token != nil {
+		return nil
+	}
+
+	token, err := a.Config.Exchange(ctx, code, oauth2.VerifierOption(a.Verifier))
+	if err != nil {
+		return fmt.Errorf("Failed to exchange token.: %w", err)
+	}
 	a.Token = token
-	fmt.Fprintf(w, "Authenticated successfully! Access Token: %s", token.AccessToken)
-	fmt.Println("Access Token:", token.AccessToken)
+	fmt.Println("Authenticated successfully")
 	close(a.Done)
+	return nil
 }
 
-func NewHttpServer(authStruct *AuthSpotify) (srv *http.Server) {
+func (a *AuthSpotify) Authorize(req *http.Request) error {
+	token := a.Token
+	if a.TokenSource != nil {
+		var err error
+		token, err = a.TokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("Error refreshing access token: %w", err)
+		}
+	}
+	if token == nil {
+		return errors.New("Not authenticated")
+	}
+
+	token.SetAuthHeader(req)
+	return nil
+}
+
+func NewHttpServer(authStruct *AuthSpotify, addr string) (srv *http.Server) {
+	callbackPath := "/"
+	if redirect, err := url.Parse(authStruct.Config.RedirectURL); err == nil && redirect.Path != "" {
+		callbackPath = redirect.Path
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/callback/spotify", authStruct.exchangeToToken)
+	mux.HandleFunc(callbackPath, authStruct.exchangeToToken)
 
+	if addr == "" {
+		addr = DefaultListenAddr
+	}
 	srv = &http.Server{
-		Addr:    ServerPort,
+		Addr:    addr,
 		Handler: mux,
 	}
 
@@ -168,338 +336,278 @@ func NewHttpServer(authStruct *AuthSpotify) (srv *http.Server) {
 
 }
 
-func (a *AuthSpotify) GenerateSpotifyAuthLink() {
-
+// AuthURL prepares a fresh PKCE verifier and state and returns the URL the
+// user has to open to grant access.
+func (a *AuthSpotify) AuthURL() string {
 	a.Verifier = oauth2.GenerateVerifier()
-	url := a.Config.AuthCodeURL("state",
+	a.State = oauth2.GenerateVerifier()
+	return a.Config.AuthCodeURL(a.State,
 		oauth2.AccessTypeOffline,
 		oauth2.S256ChallengeOption(a.Verifier),
 		oauth2.SetAuthURLParam("show_dialog", "true"),
 	)
-	fmt.Printf("Visit the URL for the auth dialog: %v\n", url)
-
 }
 
-func (s *SpotifyClient) GetUserID(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.WebConfig.SpotifyUserURL, nil)
-	if err != nil {
-		return fmt.Errorf("Error creating the request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
+func (a *AuthSpotify) GenerateSpotifyAuthLink() {
 
-	resp, err := s.WebConfig.Client.Do(req)
+	authURL := a.AuthURL()
+	fmt.Printf("Visit the URL for the auth dialog: %v\n", authURL)
 
-	if err != nil {
-		return fmt.Errorf("Error executing the request: %w", err)
-	}
-	defer resp.Body.Close()
+}
 
+func (s *SpotifyClient) GetUserID(ctx context.Context) error {
 	var response SpotifyUserID
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err := s.Do(ctx, Request{Method: http.MethodGet, URL: s.WebConfig.SpotifyUserURL}, &response)
 	if err != nil {
-		return fmt.Errorf("Error reading JSON: %w", err)
+		return err
 	}
 
 	s.ClientID = response.ID
 	return nil
 }
 
-func (s *SpotifyClient) EditPlaylistDescription(ctx context.Context, newPlaylistID, oldPlaylistID string) error {
-	playlistInfo := PlaylistInfo{
-		Description: newPlaylistID,
+// Search returns limit tracks matching q in market, starting with result
+// offset.
+func (s *SpotifyClient) Search(ctx context.Context, q, market string, limit, offset int) (SpotifySearchResponse, error) {
+	query := url.Values{}
+	query.Add("q", q)
+	query.Add("type", "track")
+	query.Add("limit", strconv.Itoa(limit))
+	if offset > 0 {
+		query.Add("offset", strconv.Itoa(offset))
 	}
-	jsonData, err := json.Marshal(playlistInfo)
-	if err != nil {
-		return fmt.Errorf("Error marshaling struct: %w", err)
-	}
-
-	if err := ctx.Err(); err != nil {
-		return err
-	}
-
-	for {
-		requestBody := bytes.NewBuffer(jsonData)
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf(s.WebConfig.ChangePlaylistDetails, oldPlaylistID), requestBody)
-		if err != nil {
-			return fmt.Errorf("Error creating the request: %w", err)
-		}
-
-		req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
-
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := s.WebConfig.Client.Do(req)
-		if err != nil {
-			return fmt.Errorf("Error while doing request: %w", err)
-		}
-		defer resp.Body.Close()
+	query.Add("market", market)
 
-		if resp.StatusCode > 299 || resp.StatusCode < 200 {
-			if resp.StatusCode == 429 {
-				retryAfterStr := resp.Header.Get("Retry-After")
-				waitTime := RateLimitWaitTime
-
-				if retryAfterStr != "" {
-					if seconds, err := strconv.Atoi(retryAfterStr); err == nil {
-						waitTime = seconds + 1
-					}
-				}
-
-				jitter := mathRand.IntN(1000)
-				log.Printf("Rate limit (429). Waiting %d seconds + %d ms of jitter...", waitTime, jitter)
-
-				time.Sleep(time.Duration(waitTime)*time.Second + time.Duration(jitter)*time.Millisecond)
-
-				continue
+	var response SpotifySearchResponse
+	err := s.Do(ctx, Request{Method: http.MethodGet, URL: s.WebConfig.SpotifySearchURL, Query: query}, &response)
+	return response, err
+}
 
-			}
+// GetTracks looks up at most SpotifyMaxTracksPerLookup tracks by ID in the
+// given market. The result has one entry per ID, in the same order, nil for
+// IDs that match no track.
+func (s *SpotifyClient) GetTracks(ctx context.Context, ids []string, market string) ([]*Track, error) {
+	if len(ids) > SpotifyMaxTracksPerLookup {
+		return nil, fmt.Errorf("Cannot look up more than %d tracks at once", SpotifyMaxTracksPerLookup)
+	}
+	query := url.Values{}
+	query.Add("ids", strings.Join(ids, ","))
+	query.Add("market", market)
 
-			if resp.StatusCode == 502 {
-				log.Printf("Error while adding to playlist. Trying again in %d seconds...", 1)
-				time.Sleep(1 * time.Second)
-				continue
-			}
+	var response TracksResponse
+	if err := s.Do(ctx, Request{Method: http.MethodGet, URL: s.WebConfig.TracksURL, Query: query}, &response); err != nil {
+		return nil, fmt.Errorf("Error looking up tracks: %w", err)
+	}
+	if len(response.Tracks) != len(ids) {
+		return nil, fmt.Errorf("Looked up %d tracks, got %d", len(ids), len(response.Tracks))
+	}
+	return response.Tracks, nil
+}
 
-			var errResp ErrorResponse
+func (s *SpotifyClient) EditPlaylistDescription(ctx context.Context, newPlaylistID, oldPlaylistID string) error {
+	return s.SetPlaylistDescription(ctx, oldPlaylistID, newPlaylistID)
+}
 
-			err := json.NewDecoder(resp.Body).Decode(&errResp)
-			if err != nil {
-				return fmt.Errorf("Error decoding JSON error: %w", err)
-			}
+func (s *SpotifyClient) SetPlaylistDescription(ctx context.Context, playlistID, description string) error {
+	playlistInfo := PlaylistInfo{
+		Description: description,
+	}
 
-			return fmt.Errorf("Error editing playlist (%d): %s", errResp.Error.Status, errResp.Error.Message)
-		}
-		break
+	err := s.Do(ctx, Request{
+		Method: http.MethodPut,
+		URL:    fmt.Sprintf(s.WebConfig.ChangePlaylistDetails, playlistID),
+		Body:   playlistInfo,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error editing playlist: %w", err)
 	}
 	return nil
+}
 
+// SetPlaylistVisibility makes a playlist public, private, or collaborative
+// (and private).
+func (s *SpotifyClient) SetPlaylistVisibility(ctx context.Context, playlistID string, public, collaborative bool) error {
+	err := s.Do(ctx, Request{
+		Method: http.MethodPut,
+		URL:    fmt.Sprintf(s.WebConfig.ChangePlaylistDetails, playlistID),
+		Body:   PlaylistInfo{Public: &public, Collaborative: &collaborative},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error changing the visibility of playlist `%s`: %w", playlistID, err)
+	}
+	return nil
 }
 
 func (s *SpotifyClient) CreatePlaylist(ctx context.Context, playlistInfo PlaylistInfo, oldPlaylistID string, playListCount int) (string, error) {
 	if playListCount > 0 {
 		playlistInfo.Name = fmt.Sprintf("%s%d", playlistInfo.Name, playListCount)
 	}
-	jsonData, err := json.Marshal(playlistInfo)
-	if err != nil {
-		return "", fmt.Errorf("Error marshaling struct: %w", err)
-	}
 
-	if err := ctx.Err(); err != nil {
-		return "", err
+	var SpotifyID SpotifyPlaylistID
+	err := s.Do(ctx, Request{
+		Method: http.MethodPost,
+		URL:    fmt.Sprintf(s.WebConfig.CreatePlaylistURL, s.ClientID),
+		Body:   playlistInfo,
+	}, &SpotifyID)
+	if err != nil {
+		return "", fmt.Errorf("Error creating playlist: %w", err)
 	}
 
-	for {
-		requestBody := bytes.NewBuffer(jsonData)
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(s.WebConfig.CreatePlaylistURL, s.ClientID), requestBody)
-		if err != nil {
-
-			return "", fmt.Errorf("Error creating the request: %w", err)
-		}
-
-		req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
-
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := s.WebConfig.Client.Do(req)
-		if err != nil {
-			return "", fmt.Errorf("Error while doing request: %w", err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-			if resp.StatusCode == 429 {
-				retryAfterStr := resp.Header.Get("Retry-After")
-				waitTime := RateLimitWaitTime
-
-				if retryAfterStr != "" {
-					if seconds, err := strconv.Atoi(retryAfterStr); err == nil {
-						waitTime = seconds + 1
-					}
-				}
-
-				jitter := mathRand.IntN(1000)
-				log.Printf("Rate limit (429). Waiting %d seconds + %d ms of jitter...", waitTime, jitter)
-
-				time.Sleep(time.Duration(waitTime)*time.Second + time.Duration(jitter)*time.Millisecond)
-
-				continue
-			}
-
-			if resp.StatusCode == 502 {
-				log.Printf("Error while adding to playlist. Trying again in %d seconds...", 1)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			var errResp ErrorResponse
-			err := json.NewDecoder(resp.Body).Decode(&errResp)
-			if err != nil {
-				return "", fmt.Errorf("Error decoding JSON error: %w", err)
-			}
-
-			return "", fmt.Errorf("Error creating playlist (%d): %s", errResp.Error.Status, errResp.Error.Message)
+	log.Println("Playlist Created")
+	if playListCount > 0 {
+		if oldPlaylistID == "" {
+			return "", fmt.Errorf("Old Playlist ID is NULL")
 		}
-		var SpotifyID SpotifyPlaylistID
-		err = json.NewDecoder(resp.Body).Decode(&SpotifyID)
+		err = s.EditPlaylistDescription(ctx, SpotifyID.ID, oldPlaylistID)
 		if err != nil {
-			log.Println("Error retrieving Spotify ID")
-			return "", fmt.Errorf("Error decoding JSON error: %w", err)
+			return "", err
 		}
 
-		log.Println("Playlist Created")
-		if playListCount > 0 {
-			if oldPlaylistID == "" {
-				return "", fmt.Errorf("Old Playlist ID is NULL")
-			}
-			err = s.EditPlaylistDescription(ctx, SpotifyID.ID, oldPlaylistID)
-			if err != nil {
-				return "", err
-			}
-
-		}
-		return SpotifyID.ID, nil
 	}
-
+	return SpotifyID.ID, nil
 }
 
 func (s *SpotifyClient) AddToPlaylist(ctx context.Context, musicURIS SpotifyAddPlaylist, playlistID string) error {
-	jsonData, err := json.Marshal(musicURIS)
+	err := s.Do(ctx, Request{
+		Method: http.MethodPost,
+		URL:    fmt.Sprintf(s.WebConfig.PlaylistURL, playlistID),
+		Body:   musicURIS,
+	}, nil)
 	if err != nil {
-
-		return fmt.Errorf("Error While marshaling: %s", err)
+		return fmt.Errorf("Error to add music to playlist `%s`: %w", playlistID, err)
 	}
+	return nil
+}
 
-	if err := ctx.Err(); err != nil {
-		return err
+// GetPlaylistTracks fetches one page of a playlist, with tracks relinked for
+// market. Pass an empty next for the first page and PlaylistItems.Next for
+// the following ones.
+func (s *SpotifyClient) GetPlaylistTracks(ctx context.Context, playlistID, market, next string) (PlaylistItems, error) {
+	r := Request{Method: http.MethodGet, URL: next}
+	if next == "" {
+		r.URL = fmt.Sprintf(s.WebConfig.PlaylistURL, playlistID)
+		r.Query = url.Values{}
+		r.Query.Add("fields", "next,items(track(uri,linked_from(uri)))")
+		r.Query.Add("limit", "50")
+		r.Query.Add("market", market)
 	}
 
-	for {
-		requestBody := bytes.NewBuffer(jsonData)
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(s.WebConfig.PlaylistURL, playlistID), requestBody)
-		if err != nil {
-			return fmt.Errorf("Error while creating request: %s", err)
-		}
-
-		req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
-
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := s.WebConfig.Client.Do(req)
-		if err != nil {
-			return fmt.Errorf("Error while requesting: %s", err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode < 200 || resp.StatusCode > 300 {
-			if resp.StatusCode == 429 {
-				retryAfterStr := resp.Header.Get("Retry-After")
-				waitTime := RateLimitWaitTime
-
-				if retryAfterStr != "" {
-					if seconds, err := strconv.Atoi(retryAfterStr); err == nil {
-						waitTime = seconds + 1
-					}
-				}
-
-				jitter := mathRand.IntN(1000)
-				log.Printf("Rate limit (429). Waiting %d seconds + %d ms of jitter...", waitTime, jitter)
-
-				time.Sleep(time.Duration(waitTime)*time.Second + time.Duration(jitter)*time.Millisecond)
-
-				continue
-
-			}
-
-			if resp.StatusCode == 502 {
-				log.Printf("Error while adding to playlist. Trying again in %d seconds...", 1)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			var errResp ErrorResponse
-			err = json.NewDecoder(resp.Body).Decode(&errResp)
-			if err != nil {
-				return fmt.Errorf("Error decoding JSON error: %s", err)
-			}
-			return fmt.Errorf("Error to add music to playlist `%s` (%d): %s", playlistID, errResp.Error.Status, errResp.Error.Message)
-		}
-		break
+	var items PlaylistItems
+	if err := s.Do(ctx, r, &items); err != nil {
+		return PlaylistItems{}, fmt.Errorf("Error to get tracks of playlist `%s`: %w", playlistID, err)
 	}
-
-	return nil
+	return items, nil
 }
 
 func (s *SpotifyClient) GetNextPlaylist(ctx context.Context, PlaylistID string) (string, error) {
-	for {
-		if err := ctx.Err(); err != nil {
-			return "", err
-		}
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(s.WebConfig.GetPlaylist, PlaylistID), nil)
-		if err != nil {
-			return "", fmt.Errorf("Error while creating request: %s", err)
-		}
-
-		req.Header.Set("Authorization", "Bearer "+s.Auth.Token.AccessToken)
-
-		query := req.URL.Query()
-		query.Add("fields", "description")
-
-		req.URL.RawQuery = query.Encode()
-
-		resp, err := s.WebConfig.Client.Do(req)
-		if err != nil {
-			return "", fmt.Errorf("Error while requesting: %s", err)
-		}
-		defer resp.Body.Close()
+	query := url.Values{}
+	query.Add("fields", "description")
+
+	var description PlaylistInfo
+	err := s.Do(ctx, Request{
+		Method: http.MethodGet,
+		URL:    fmt.Sprintf(s.WebConfig.GetPlaylist, PlaylistID),
+		Query:  query,
+	}, &description)
+	if err != nil {
+		return "", fmt.Errorf("Error to get playlist description `%s`: %w", PlaylistID, err)
+	}
 
-		if resp.StatusCode < 200 || resp.StatusCode > 300 {
+	if description.Description == "null" || description.Description == "" {
+		return "", ErrNoMorePlaylist
+	}
 
-			if resp.StatusCode == 429 {
-				retryAfterStr := resp.Header.Get("Retry-After")
-				waitTime := RateLimitWaitTime
+	return description.Description, nil
+}
 
-				if retryAfterStr != "" {
-					if seconds, err := strconv.Atoi(retryAfterStr); err == nil {
-						waitTime = seconds + 1
-					}
-				}
+func (s *SpotifyClient) GetPlaylistDetails(ctx context.Context, playlistID string) (PlaylistDetails, error) {
+	query := url.Values{}
+	query.Add("fields", "id,name,description,public,collaborative,owner(id),tracks(total)")
 
-				jitter := mathRand.IntN(1000)
-				log.Printf("Rate limit (429). Waiting %d seconds + %d ms of jitter...", waitTime, jitter)
+	var details PlaylistDetails
+	err := s.Do(ctx, Request{
+		Method: http.MethodGet,
+		URL:    fmt.Sprintf(s.WebConfig.GetPlaylist, playlistID),
+		Query:  query,
+	}, &details)
+	if err != nil {
+		return PlaylistDetails{}, fmt.Errorf("Error to get playlist details `%s`: %w", playlistID, err)
+	}
 
-				time.Sleep(time.Duration(waitTime)*time.Second + time.Duration(jitter)*time.Millisecond)
+	return details, nil
+}
 
-				continue
-			}
+// GetMyPlaylists fetches one page of the playlists the current user owns or
+// follows. Pass an empty next for the first page and PlaylistPage.Next for the
+// following ones.
+func (s *SpotifyClient) GetMyPlaylists(ctx context.Context, next string) (PlaylistPage, error) {
+	r := Request{Method: http.MethodGet, URL: next}
+	if next == "" {
+		r.URL = s.WebConfig.MyPlaylistsURL
+		r.Query = url.Values{}
+		r.Query.Add("limit", strconv.Itoa(SpotifyMaxPlaylistsPerPage))
+	}
 
-			if resp.StatusCode == 502 {
-				log.Printf("Error while adding to playlist. Trying again in %d seconds...", 1)
-				time.Sleep(1 * time.Second)
-				continue
-			}
+	var page PlaylistPage
+	if err := s.Do(ctx, r, &page); err != nil {
+		return PlaylistPage{}, fmt.Errorf("Error to list the playlists of the user: %w", err)
+	}
+	return page, nil
+}
 
-			var errResp ErrorResponse
-			err = json.NewDecoder(resp.Body).Decode(&errResp)
-			if err != nil {
-				return "", fmt.Errorf("Error decoding JSON error: %s", err)
-			}
-			return "", fmt.Errorf("Error to get playlist description `%s` (%d): %s", PlaylistID, errResp.Error.Status, errResp.Error.Message)
-		}
+// UploadPlaylistCover replaces the cover of a playlist with a JPEG image.
+// Spotify processes the image asynchronously and re-encodes it.
+func (s *SpotifyClient) UploadPlaylistCover(ctx context.Context, playlistID string, jpeg []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(jpeg)
+	if len(encoded) > SpotifyMaxCoverSize {
+		return fmt.Errorf("Cover of playlist `%s` is too large: %d bytes encoded, at most %d", playlistID, len(encoded), SpotifyMaxCoverSize)
+	}
+	err := s.Do(ctx, Request{
+		Method:      http.MethodPut,
+		URL:         fmt.Sprintf(s.WebConfig.PlaylistImagesURL, playlistID),
+		RawBody:     []byte(encoded),
+		ContentType: "image/jpeg",
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error to upload the cover of playlist `%s`: %w", playlistID, err)
+	}
+	return nil
+}
 
-		var description PlaylistInfo
-		err = json.NewDecoder(resp.Body).Decode(&description)
-		if err != nil {
-			return "", fmt.Errorf("Error to decode response: %w", err)
-		}
+// GetPlaylistCover downloads the largest size of a playlist's cover.
+func (s *SpotifyClient) GetPlaylistCover(ctx context.Context, playlistID string) ([]byte, error) {
+	var images []Image
+	err := s.Do(ctx, Request{
+		Method: http.MethodGet,
+		URL:    fmt.Sprintf(s.WebConfig.PlaylistImagesURL, playlistID),
+	}, &images)
+	if err != nil {
+		return nil, fmt.Errorf("Error to get the cover of playlist `%s`: %w", playlistID, err)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoCover, playlistID)
+	}
 
-		if description.Description == "null" {
-			return "", ErrNoMorePlaylist
+	largest := images[0]
+	for _, image := range images[1:] {
+		if image.Width != nil && (largest.Width == nil || *image.Width > *largest.Width) {
+			largest = image
 		}
+	}
+	var data []byte
+	if err := s.Do(ctx, Request{Method: http.MethodGet, URL: largest.URL, Anonymous: true}, &data); err != nil {
+		return nil, fmt.Errorf("Error to download the cover of playlist `%s`: %w", playlistID, err)
+	}
+	return data, nil
+}
 
-		return description.Description, nil
+func (s *SpotifyClient) UnfollowPlaylist(ctx context.Context, playlistID string) error {
+	err := s.Do(ctx, Request{
+		Method: http.MethodDelete,
+		URL:    fmt.Sprintf(s.WebConfig.UnfollowPlaylistURL, playlistID),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error to unfollow playlist `%s`: %w", playlistID, err)
 	}
+	return nil
 }
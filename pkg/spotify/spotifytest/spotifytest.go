@@ -0,0 +1,732 @@
+// Package spotifytest provides an in-process fake of the parts of the Spotify
+// Web API used by spotify-fs, so that uploads and downloads can be exercised
+// offline.
+package spotifytest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"spotifyfs/pkg/spotify"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	UserID      = "spotifytest-user"
+	AccessToken = "spotifytest-token"
+	// GuestUserID is another user, who reads the public playlists of
+	// UserID and the collaborative ones, as if invited to them.
+	GuestUserID      = "spotifytest-guest"
+	GuestAccessToken = "spotifytest-guest-token"
+
+	maxTracksPerAdd  = 100
+	maxItemsPerPage  = 100
+	maxSearchResults = 50
+	maxDescription   = 300
+	// coverQuality is the JPEG quality covers are re-encoded with, as
+	// Spotify does with every cover uploaded.
+	coverQuality = 75
+)
+
+type Playlist struct {
+	ID            string
+	Name          string
+	Description   string
+	Public        bool
+	Collaborative bool
+	Tracks        []string
+	// Cover is the JPEG image served as the playlist's cover, nil for
+	// none.
+	Cover []byte
+}
+
+// Fault makes the server answer matching requests with an error instead of
+// serving them. Method and Path (a prefix of the URL path) match anything
+// when empty.
+type Fault struct {
+	Method     string
+	Path       string
+	Status     int
+	RetryAfter int
+	// Malformed answers 200 with a body that is not valid JSON.
+	Malformed bool
+	// After serves the request before answering with the fault, like a
+	// response lost once the server applied the request.
+	After bool
+	// Times is how many requests the fault applies to; 0 means forever.
+	Times int
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	playlists map[string]*Playlist
+	order     []string
+	faults    []*Fault
+	nextID    int
+	requests  int
+
+	// Catalog changes, keyed by track URI: tracks relinked to another URI,
+	// removed from the catalog or not playable in any market, with why.
+	relinked   map[string]string
+	removed    map[string]bool
+	restricted map[string]string
+
+	// unfollowed playlists can still be read by ID, as on Spotify, but
+	// are no longer the user's.
+	unfollowed map[string]bool
+}
+
+func NewServer() *Server {
+	s := &Server{
+		playlists:  make(map[string]*Playlist),
+		relinked:   make(map[string]string),
+		removed:    make(map[string]bool),
+		restricted: make(map[string]string),
+		unfollowed: make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/me", s.handleMe)
+	mux.HandleFunc("GET /v1/me/playlists", s.handleMyPlaylists)
+	mux.HandleFunc("GET /v1/search", s.handleSearch)
+	mux.HandleFunc("POST /v1/users/{user}/playlists", s.handleCreatePlaylist)
+	mux.HandleFunc("GET /v1/playlists/{id}", s.handleGetPlaylist)
+	mux.HandleFunc("PUT /v1/playlists/{id}", s.handleEditPlaylist)
+	mux.HandleFunc("GET /v1/playlists/{id}/tracks", s.handleGetTracks)
+	mux.HandleFunc("POST /v1/playlists/{id}/tracks", s.handleAddTracks)
+	mux.HandleFunc("DELETE /v1/playlists/{id}/followers", s.handleUnfollow)
+	mux.HandleFunc("GET /v1/tracks", s.handleLookupTracks)
+	mux.HandleFunc("PUT /v1/playlists/{id}/images", s.handleUploadCover)
+	mux.HandleFunc("GET /v1/playlists/{id}/images", s.handleGetCover)
+	mux.HandleFunc("GET /images/{id}", s.handleCoverImage)
+
+	s.Server = httptest.NewServer(s.middleware(mux))
+	return s
+}
+
+// WebClient returns a configuration pointing every endpoint at the fake, with
+// a retry policy short enough for tests.
+func (s *Server) WebClient() spotify.WebClient {
+	return spotify.WebClient{
+		Client: s.Client(),
+		Retry: spotify.RetryPolicy{
+			MaxAttempts: 5,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    10 * time.Millisecond,
+		},
+		SpotifySearchURL:      s.URL + "/v1/search",
+		SpotifyUserURL:        s.URL + "/v1/me",
+		CreatePlaylistURL:     s.URL + "/v1/users/%s/playlists",
+		PlaylistURL:           s.URL + "/v1/playlists/%s/tracks",
+		ChangePlaylistDetails: s.URL + "/v1/playlists/%s",
+		GetPlaylist:           s.URL + "/v1/playlists/%s",
+		UnfollowPlaylistURL:   s.URL + "/v1/playlists/%s/followers",
+		TracksURL:             s.URL + "/v1/tracks",
+		PlaylistImagesURL:     s.URL + "/v1/playlists/%s/images",
+		MyPlaylistsURL:        s.URL + "/v1/me/playlists",
+	}
+}
+
+// NewClient returns a client already authenticated against the fake.
+func (s *Server) NewClient() *spotify.SpotifyClient {
+	return s.newClient(UserID, AccessToken)
+}
+
+// NewGuestClient returns a client authenticated as GuestUserID.
+func (s *Server) NewGuestClient() *spotify.SpotifyClient {
+	return s.newClient(GuestUserID, GuestAccessToken)
+}
+
+func (s *Server) newClient(user, token string) *spotify.SpotifyClient {
+	return &spotify.SpotifyClient{
+		Auth: &spotify.AuthSpotify{
+			Token: &oauth2.Token{AccessToken: token, TokenType: "Bearer"},
+			Done:  make(chan struct{}),
+		},
+		ClientID:  user,
+		WebConfig: s.WebClient(),
+	}
+}
+
+// Inject adds a fault. It panics when the fault has neither Status nor
+// Malformed set, as it would have nothing to answer.
+func (s *Server) Inject(f Fault) {
+	if f.Status == 0 && !f.Malformed {
+		panic("spotifytest: a fault needs a Status or Malformed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Requests returns how many requests reached the server, faults included.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) Playlist(id string) (Playlist, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.playlists[id]
+	if !ok {
+		return Playlist{}, false
+	}
+	copied := *p
+	copied.Tracks = append([]string(nil), p.Tracks...)
+	copied.Cover = append([]byte(nil), p.Cover...)
+	return copied, true
+}
+
+// Playlists returns the playlists the user follows, in creation order.
+func (s *Server) Playlists() []Playlist {
+	var playlists []Playlist
+	for _, id := range s.ids() {
+		if p, ok := s.Playlist(id); ok && !s.Unfollowed(id) {
+			playlists = append(playlists, p)
+		}
+	}
+	return playlists
+}
+
+// Unfollowed reports whether the user unfollowed the playlist id.
+func (s *Server) Unfollowed(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unfollowed[id]
+}
+
+func (s *Server) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.order...)
+}
+
+// SetTrack overwrites one track of a playlist, e.g. to simulate a track that
+// was removed from the catalog or relinked.
+func (s *Server) SetTrack(playlistID string, position int, uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.playlists[playlistID].Tracks[position] = uri
+}
+
+// ClearTracks removes every track of a playlist, as its owner can.
+func (s *Server) ClearTracks(playlistID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.playlists[playlistID].Tracks = nil
+}
+
+// RelinkTrack makes the catalog answer uri with the track to instead, as
+// Spotify does when a track is replaced by another one in a market. Playlists
+// that hold uri then return to, linked from uri.
+func (s *Server) RelinkTrack(uri, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relinked[uri] = to
+}
+
+// RemoveTrack takes uri out of the catalog: looking it up finds nothing.
+func (s *Server) RemoveTrack(uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed[uri] = true
+}
+
+// RestrictTrack makes uri unplayable for the given reason.
+func (s *Server) RestrictTrack(uri, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restricted[uri] = reason
+}
+
+// SearchResults returns the tracks the fake search answers for q in market;
+// it is deterministic so that dictionaries can be regenerated, and differs
+// between markets like the real catalog does.
+func SearchResults(q, market string) []string {
+	sum := sha256.Sum256([]byte(market + "\x00" + q))
+	// Roughly one query in four finds nothing, like short random strings
+	// often do on the real API.
+	if sum[0]%4 == 0 {
+		return nil
+	}
+	count := 1 + int(sum[1])%maxSearchResults
+	results := make([]string, count)
+	for i := range results {
+		item := sha256.Sum256(append(sum[:], byte(i)))
+		results[i] = "spotify:track:" + hex.EncodeToString(item[:11])
+	}
+	return results
+}
+
+func (s *Server) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		fault := s.matchFault(r)
+		s.mu.Unlock()
+
+		if fault != nil && !fault.After {
+			writeFault(w, fault)
+			return
+		}
+
+		// Cover images are served by a CDN that needs no token.
+		token := r.Header.Get("Authorization")
+		if !strings.HasPrefix(r.URL.Path, "/images/") && token != "Bearer "+AccessToken && token != "Bearer "+GuestAccessToken {
+			writeError(w, http.StatusUnauthorized, "Invalid access token")
+			return
+		}
+		if guest(r) && r.Method != http.MethodGet {
+			writeError(w, http.StatusForbidden, "You cannot modify playlists of another user")
+			return
+		}
+		if fault != nil {
+			next.ServeHTTP(httptest.NewRecorder(), r)
+			writeFault(w, fault)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeFault(w http.ResponseWriter, fault *Fault) {
+	if fault.Malformed {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"broken":`)
+		return
+	}
+	if fault.RetryAfter > 0 || fault.Status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+	}
+	writeError(w, fault.Status, "Injected fault")
+}
+
+func (s *Server) matchFault(r *http.Request) *Fault {
+	for i, f := range s.faults {
+		if f.Method != "" && f.Method != r.Method {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, spotify.ErrorResponse{Error: spotify.ErrorDetail{Status: status, Message: message}})
+}
+
+// lookup finds the playlist a request is about. Like Spotify, it answers
+// that private playlists do not exist to other users.
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) (*Playlist, bool) {
+	p, ok := s.playlists[r.PathValue("id")]
+	if ok && guest(r) && !p.Public && !p.Collaborative {
+		ok = false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "Resource not found")
+	}
+	return p, ok
+}
+
+func guest(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "Bearer "+GuestAccessToken
+}
+
+func intParam(query url.Values, key string, def int) int {
+	if v, err := strconv.Atoi(query.Get(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	if guest(r) {
+		writeJSON(w, http.StatusOK, spotify.SpotifyUserID{ID: GuestUserID})
+		return
+	}
+	writeJSON(w, http.StatusOK, spotify.SpotifyUserID{ID: UserID})
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := intParam(query, "limit", 20)
+	offset := intParam(query, "offset", 0)
+	if query.Get("q") == "" || limit < 1 || limit > maxSearchResults {
+		writeError(w, http.StatusBadRequest, "Invalid search")
+		return
+	}
+
+	var response spotify.SpotifySearchResponse
+	response.Tracks.Items = []spotify.SpotifyItem{}
+	results := SearchResults(query.Get("q"), query.Get("market"))
+	for i := offset; i < len(results) && i < offset+limit; i++ {
+		response.Tracks.Items = append(response.Tracks.Items, spotify.SpotifyItem{URI: results[i]})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleCreatePlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("user") != UserID {
+		writeError(w, http.StatusForbidden, "You cannot create a playlist for another user")
+		return
+	}
+	var info spotify.PlaylistInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.Name == "" {
+		writeError(w, http.StatusBadRequest, "Invalid playlist")
+		return
+	}
+	if len(info.Description) > maxDescription {
+		writeError(w, http.StatusBadRequest, "Description too long")
+		return
+	}
+	p := &Playlist{
+		Name:          info.Name,
+		Description:   info.Description,
+		Public:        info.Public == nil || *info.Public,
+		Collaborative: info.Collaborative != nil && *info.Collaborative,
+	}
+	if p.Public && p.Collaborative {
+		writeError(w, http.StatusBadRequest, "Collaborative playlists cannot be public")
+		return
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	p.ID = fmt.Sprintf("playlist%014d", s.nextID)
+	s.playlists[p.ID] = p
+	s.order = append(s.order, p.ID)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, spotify.SpotifyPlaylistID{ID: p.ID})
+}
+
+func (s *Server) handleGetPlaylist(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p.details())
+}
+
+func (p *Playlist) details() spotify.PlaylistDetails {
+	var details spotify.PlaylistDetails
+	details.ID = p.ID
+	details.Name = p.Name
+	details.Description = p.Description
+	details.Public = p.Public
+	details.Collaborative = p.Collaborative
+	details.Owner.ID = UserID
+	details.Tracks.Total = len(p.Tracks)
+	return details
+}
+
+// handleMyPlaylists lists every playlist of the fake the user follows, which
+// are all owned by UserID, most recently created first like Spotify does. The guest has
+// none.
+func (s *Server) handleMyPlaylists(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := intParam(query, "limit", 20)
+	offset := intParam(query, "offset", 0)
+	if limit < 1 || limit > spotify.SpotifyMaxPlaylistsPerPage || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid limit or offset")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var playlists []*Playlist
+	for i := len(s.order) - 1; i >= 0 && !guest(r); i-- {
+		if p := s.playlists[s.order[i]]; !s.unfollowed[p.ID] {
+			playlists = append(playlists, p)
+		}
+	}
+	page := struct {
+		Items []spotify.PlaylistDetails `json:"items"`
+		Next  *string                   `json:"next"`
+		Total int                       `json:"total"`
+	}{Items: []spotify.PlaylistDetails{}, Total: len(playlists)}
+	for i := offset; i < len(playlists) && i < offset+limit; i++ {
+		page.Items = append(page.Items, playlists[i].details())
+	}
+	if offset+limit < len(playlists) {
+		next := *r.URL
+		next.Scheme, next.Host = "http", r.Host
+		nextQuery := next.Query()
+		nextQuery.Set("offset", strconv.Itoa(offset+limit))
+		nextQuery.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = nextQuery.Encode()
+		nextURL := next.String()
+		page.Next = &nextURL
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) handleEditPlaylist(w http.ResponseWriter, r *http.Request) {
+	var info spotify.PlaylistInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid body")
+		return
+	}
+	if len(info.Description) > maxDescription {
+		writeError(w, http.StatusBadRequest, "Description too long")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	if info.Name != "" {
+		p.Name = info.Name
+	}
+	if info.Description != "" {
+		p.Description = info.Description
+	}
+	public, collaborative := p.Public, p.Collaborative
+	if info.Public != nil {
+		public = *info.Public
+	}
+	if info.Collaborative != nil {
+		collaborative = *info.Collaborative
+	}
+	if public && collaborative {
+		writeError(w, http.StatusBadRequest, "Collaborative playlists cannot be public")
+		return
+	}
+	p.Public, p.Collaborative = public, collaborative
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleGetTracks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := intParam(query, "limit", maxItemsPerPage)
+	offset := intParam(query, "offset", 0)
+	if limit < 1 || limit > maxItemsPerPage || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid limit or offset")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	type linked struct {
+		URI string `json:"uri"`
+	}
+	type item struct {
+		Track struct {
+			URI        string  `json:"uri"`
+			LinkedFrom *linked `json:"linked_from,omitempty"`
+		} `json:"track"`
+	}
+	page := struct {
+		Items []item  `json:"items"`
+		Next  *string `json:"next"`
+		Total int     `json:"total"`
+	}{Items: []item{}, Total: len(p.Tracks)}
+
+	for i := offset; i < len(p.Tracks) && i < offset+limit; i++ {
+		var it item
+		it.Track.URI = p.Tracks[i]
+		if to, ok := s.relinked[p.Tracks[i]]; ok && query.Get("market") != "" {
+			it.Track.URI = to
+			it.Track.LinkedFrom = &linked{URI: p.Tracks[i]}
+		}
+		page.Items = append(page.Items, it)
+	}
+	if offset+limit < len(p.Tracks) {
+		next := *r.URL
+		next.Scheme, next.Host = "http", r.Host
+		nextQuery := next.Query()
+		nextQuery.Set("offset", strconv.Itoa(offset+limit))
+		nextQuery.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = nextQuery.Encode()
+		nextURL := next.String()
+		page.Next = &nextURL
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) handleAddTracks(w http.ResponseWriter, r *http.Request) {
+	var body spotify.SpotifyAddPlaylist
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid body")
+		return
+	}
+	if len(body.MusicURIS) == 0 || len(body.MusicURIS) > maxTracksPerAdd {
+		writeError(w, http.StatusBadRequest, "You can add a maximum of 100 tracks per request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	for _, uri := range body.MusicURIS {
+		if !strings.HasPrefix(uri, "spotify:track:") {
+			writeError(w, http.StatusBadRequest, "Invalid track uri: "+uri)
+			return
+		}
+	}
+	p.Tracks = append(p.Tracks, body.MusicURIS...)
+	writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": strconv.Itoa(len(p.Tracks))})
+}
+
+func (s *Server) handleUnfollow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	// Spotify keeps an unfollowed playlist readable by its ID, and
+	// unfollowing it again succeeds.
+	s.unfollowed[p.ID] = true
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleLookupTracks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ids := strings.Split(query.Get("ids"), ",")
+	if query.Get("ids") == "" || len(ids) > spotify.SpotifyMaxTracksPerLookup {
+		writeError(w, http.StatusBadRequest, "Invalid ids")
+		return
+	}
+	market := query.Get("market")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var response spotify.TracksResponse
+	for _, id := range ids {
+		uri := "spotify:track:" + id
+		if id == "" || s.removed[uri] {
+			response.Tracks = append(response.Tracks, nil)
+			continue
+		}
+
+		track := &spotify.Track{ID: id, URI: uri}
+		if to, ok := s.relinked[uri]; ok && market != "" {
+			track.ID, track.URI = strings.TrimPrefix(to, "spotify:track:"), to
+			track.LinkedFrom = &spotify.LinkedTrack{ID: id, URI: uri}
+		}
+		if market != "" {
+			playable := true
+			if reason, ok := s.restricted[uri]; ok {
+				playable = false
+				track.Restrictions = &spotify.TrackRestrictions{Reason: reason}
+			}
+			track.IsPlayable = &playable
+		}
+		response.Tracks = append(response.Tracks, track)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleUploadCover(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, spotify.SpotifyMaxCoverSize+1))
+	if err != nil || len(body) > spotify.SpotifyMaxCoverSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "Image too large")
+		return
+	}
+	if r.Header.Get("Content-Type") != "image/jpeg" {
+		writeError(w, http.StatusBadRequest, "Expected image/jpeg")
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid base64 image")
+		return
+	}
+	img, err := jpeg.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JPEG image")
+		return
+	}
+	var cover bytes.Buffer
+	if err := jpeg.Encode(&cover, img, &jpeg.Options{Quality: coverQuality}); err != nil {
+		writeError(w, http.StatusInternalServerError, "Cannot encode image")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	p.Cover = cover.Bytes()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) handleGetCover(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	images := []spotify.Image{}
+	if p.Cover != nil {
+		config, err := jpeg.DecodeConfig(bytes.NewReader(p.Cover))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Invalid cover")
+			return
+		}
+		images = append(images, spotify.Image{URL: s.URL + "/images/" + p.ID, Width: &config.Width, Height: &config.Height})
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+func (s *Server) handleCoverImage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.playlists[r.PathValue("id")]
+	if !ok || p.Cover == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(p.Cover)
+}
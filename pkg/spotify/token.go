@@ -0,0 +1,85 @@
+package spotify
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// PersistentTokenSource refreshes the access token when it expires and hands
+// every new token to Save so it survives between runs.
+type PersistentTokenSource struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	conf   *oauth2.Config
+	source oauth2.TokenSource
+	last   *oauth2.Token
+	Save   func(*oauth2.Token) error
+}
+
+func NewPersistentTokenSource(ctx context.Context, conf *oauth2.Config, token *oauth2.Token, save func(*oauth2.Token) error) *PersistentTokenSource {
+	return &PersistentTokenSource{
+		ctx:    ctx,
+		conf:   conf,
+		source: conf.TokenSource(ctx, token),
+		last:   token,
+		Save:   save,
+	}
+}
+
+// Invalidate makes the next call to Token use the refresh token, even if the
+// current access token has not expired yet (e.g. after the API answered 401).
+func (p *PersistentTokenSource) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.last == nil || p.last.RefreshToken == "" {
+		return
+	}
+	p.source = p.conf.TokenSource(p.ctx, &oauth2.Token{RefreshToken: p.last.RefreshToken})
+}
+
+func (p *PersistentTokenSource) Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	token, err := p.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.last == nil || token.AccessToken != p.last.AccessToken {
+		p.last = token
+		if p.Save != nil {
+			if err := p.Save(token); err != nil {
+				log.Printf("Error saving refreshed token: %v", err)
+			}
+		}
+	}
+
+	return token, nil
+}
+
+// GrantedScopes returns the scopes the authorization server reported granting
+// with token, or known when it did not say, as refreshes may not.
+func GrantedScopes(token *oauth2.Token, known []string) []string {
+	if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope)
+	}
+	return known
+}
+
+// MissingScopes returns the scopes of wanted that are not among granted.
+func MissingScopes(wanted, granted []string) []string {
+	var missing []string
+	for _, scope := range wanted {
+		if !slices.Contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,38 @@
+package spotify_test
+
+import (
+	"slices"
+	"spotifyfs/pkg/spotify"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	known := []string{"playlist-read-private"}
+	token := &oauth2.Token{AccessToken: "access"}
+	if got := spotify.GrantedScopes(token, known); !slices.Equal(got, known) {
+		t.Fatalf("Without a scope field got %v, want %v", got, known)
+	}
+	token = token.WithExtra(map[string]any{"scope": "playlist-read-private ugc-image-upload"})
+	if got := spotify.GrantedScopes(token, known); !slices.Equal(got, []string{"playlist-read-private", "ugc-image-upload"}) {
+		t.Fatalf("Got %v", got)
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	wanted := []string{"playlist-read-private", "ugc-image-upload"}
+	tests := []struct {
+		granted []string
+		missing []string
+	}{
+		{nil, wanted},
+		{[]string{"playlist-read-private"}, []string{"ugc-image-upload"}},
+		{[]string{"ugc-image-upload", "playlist-read-private", "user-read-email"}, nil},
+	}
+	for _, tt := range tests {
+		if got := spotify.MissingScopes(wanted, tt.granted); !slices.Equal(got, tt.missing) {
+			t.Errorf("MissingScopes(%v) = %v, want %v", tt.granted, got, tt.missing)
+		}
+	}
+}
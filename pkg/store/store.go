@@ -0,0 +1,64 @@
+// Package store keeps data in Spotify playlists for programs that embed
+// spotifyfs, reading it from an io.Reader and writing it back to an io.Writer
+// through the same encoding and workers as the command line tool.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"spotifyfs/pkg/job"
+	"spotifyfs/pkg/spotify"
+	"time"
+)
+
+// Handle is what Get needs to find data stored by Put: the ID of the head of
+// its index.
+type Handle string
+
+// Store puts and gets data in the account of a client, encrypted with a
+// password.
+type Store struct {
+	client   *spotify.SpotifyClient
+	password string
+
+	// DictionaryCache is used by Put and Get, see job.WriteOptions.
+	DictionaryCache string
+}
+
+func New(client *spotify.SpotifyClient, password string) *Store {
+	return &Store{client: client, password: password}
+}
+
+// PutOptions describes how Put stores data. Name is required; it names the
+// playlists and is the file name the command line tool restores the data
+// to. WriteOptions.Journal can be set to make the upload resumable, by calling
+// Put again with Resume and the same data.
+type PutOptions struct {
+	Name string
+	job.WriteOptions
+}
+
+// Put reads r to its end and stores what it yields. Nothing is held in memory
+// beyond the playlists being written. The number of bytes read is recorded in
+// the index, so List reports it, but no hash is: the encryption authenticates
+// the data instead.
+func (st *Store) Put(ctx context.Context, r io.Reader, opts PutOptions) (Handle, error) {
+	if opts.Name == "" {
+		return "", errors.New("A name is required")
+	}
+	if opts.DictionaryCache == "" {
+		opts.DictionaryCache = st.DictionaryCache
+	}
+	manifest := job.Manifest{Name: opts.Name, ModTime: time.Now().Unix(), Streamed: true}
+	id, err := job.Put(ctx, st.client, r, manifest, st.password, opts.Name, opts.WriteOptions)
+	return Handle(id), err
+}
+
+// Get writes the data stored under h to w. Playlists are written in order as
+// soon as they are read, so when Get fails w may already hold part of the
+// data, which must not be used.
+func (st *Store) Get(ctx context.Context, h Handle, w io.Writer) error {
+	_, err := job.Get(ctx, st.client, string(h), w, st.password, job.ReadOptions{DictionaryCache: st.DictionaryCache})
+	return err
+}
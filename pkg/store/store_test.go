@@ -0,0 +1,49 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"spotifyfs/pkg/job"
+	"spotifyfs/pkg/spotify/spotifytest"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := srv.NewClient()
+	st := New(client, "correct horse")
+	ctx := context.Background()
+
+	data := make([]byte, 30000)
+	rand.New(rand.NewSource(1)).Read(data)
+	h, err := st.Put(ctx, bytes.NewReader(data), PutOptions{Name: "stream", WriteOptions: job.WriteOptions{Compression: job.CompressionNone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := st.Get(ctx, h, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("Get returned other data")
+	}
+
+	uploads, err := job.List(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || uploads[0].Size != int64(len(data)) {
+		t.Fatalf("List returned %+v, want one upload of %d bytes", uploads, len(data))
+	}
+}
+
+func TestPutNeedsName(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	if _, err := New(srv.NewClient(), "correct horse").Put(context.Background(), bytes.NewReader(nil), PutOptions{}); err == nil {
+		t.Fatal("Put accepted no name")
+	}
+}